@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// alertPoints creates one `ecobee_alert` point per alert on the thermostat.
+// ecobee has no structured way to say which sensor an alert is about, so
+// alerts whose text mentions "battery" count as low battery alerts, and
+// alerts that name one of sensors are tagged with its name.
+func alertPoints(alerts []ecobee.Alert, sensors []ecobee.RemoteSensor, meta map[string]string, now time.Time) []*influxclient.Point {
+	points := []*influxclient.Point{}
+	for _, alert := range alerts {
+		tags := map[string]string{
+			"alert_number": strconv.Itoa(alert.AlertNumber),
+		}
+		for _, sensor := range sensors {
+			if sensor.Name != "" && strings.Contains(alert.Text, sensor.Name) {
+				tags["sensor_name"] = sensor.Name
+				break
+			}
+		}
+		for k, v := range meta {
+			tags[k] = v
+		}
+
+		// Date and time are in thermostat time.
+		fields := map[string]interface{}{
+			"text":              alert.Text,
+			"severity":          alert.Severity,
+			"alert_type":        alert.AlertType,
+			"notification_type": alert.NotificationType,
+			"alert_time":        alert.Date + " " + alert.Time,
+			"low_battery":       strings.Contains(strings.ToLower(alert.Text), "battery"),
+		}
+
+		pt, err := influxclient.NewPoint("ecobee_alert", tags, fields, now)
+		if err != nil {
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points
+}
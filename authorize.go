@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// authorizeURL is where the user enters the PIN, under My Apps.
+const authorizeURL = "https://www.ecobee.com/consumerportal/index.html"
+
+// authorizeApp requests a PIN for the app and prints it as JSON on stdout for
+// the user (or a script) to enter at authorizeURL. Once the user presses
+// Enter, or with poll as soon as ecobee reports the PIN authorized, the
+// credentials are saved to cacheFile.
+func authorizeApp(apiKey, cacheFile string, poll bool) error {
+	pin, err := ecobee.Authorize(apiKey)
+	if err != nil {
+		return fmt.Errorf("unable to request a PIN: %s", err)
+	}
+	out := struct {
+		Pin              string `json:"pin"`
+		AuthorizeURL     string `json:"authorize_url"`
+		ExpiresInMinutes int    `json:"expires_in_minutes"`
+	}{pin.EcobeePin, authorizeURL, pin.ExpiresIn}
+	if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+		return err
+	}
+
+	if !poll {
+		log.Printf("Enter PIN %s under My Apps at %s, then press Enter.", pin.EcobeePin, authorizeURL)
+		bufio.NewReader(os.Stdin).ReadString('\n')
+		return ecobee.SaveToken(apiKey, cacheFile, pin.Code)
+	}
+
+	// ecobee rejects token requests until the PIN has been entered.
+	interval := time.Duration(pin.Interval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	expiresIn := time.Duration(pin.ExpiresIn) * time.Minute
+	if expiresIn <= 0 {
+		expiresIn = 10 * time.Minute
+	}
+	deadline := time.Now().Add(expiresIn)
+	log.Printf("Enter PIN %s under My Apps at %s; checking every %v.", pin.EcobeePin, authorizeURL, interval)
+	for {
+		time.Sleep(interval)
+		err := ecobee.SaveToken(apiKey, cacheFile, pin.Code)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("PIN %s expired before it was authorized: %s", pin.EcobeePin, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+)
+
+// changeTracker remembers the last point written for each measurement and tag
+// set, for write_changed_only. A point whose fields are the same as last time
+// is skipped, unless heartbeat has passed since it was last written.
+type changeTracker struct {
+	mu        sync.Mutex
+	heartbeat time.Duration
+	last      map[string]writtenPoint
+}
+
+type writtenPoint struct {
+	fields  string
+	written time.Time
+}
+
+func newChangeTracker(heartbeat time.Duration) *changeTracker {
+	return &changeTracker{heartbeat: heartbeat, last: map[string]writtenPoint{}}
+}
+
+// pointKey identifies a series. fmt prints maps sorted by key, so the same
+// tags and fields always give the same strings.
+func pointKey(pt *influxclient.Point) (string, string) {
+	fields, _ := pt.Fields()
+	return pt.Name() + fmt.Sprint(pt.Tags()), fmt.Sprint(fields)
+}
+
+// changed reports whether pt needs to be written.
+func (c *changeTracker) changed(pt *influxclient.Point, now time.Time) bool {
+	key, fields := pointKey(pt)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.last[key]
+	return !ok || last.fields != fields || now.Sub(last.written) >= c.heartbeat
+}
+
+// record notes that points were written at now.
+func (c *changeTracker) record(points []*influxclient.Point, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pt := range points {
+		key, fields := pointKey(pt)
+		c.last[key] = writtenPoint{fields: fields, written: now}
+	}
+}
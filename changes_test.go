@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+func TestChangeTracker(t *testing.T) {
+	c := newChangeTracker(time.Hour)
+	start := time.Date(2023, 1, 2, 8, 0, 0, 0, time.UTC)
+	point := func(temp float64) *influxclient.Point {
+		pt, _ := influxclient.NewPoint("ecobee_sensor", map[string]string{"sensor_id": "rs:100"},
+			map[string]interface{}{"temperature_°F": temp}, start)
+		return pt
+	}
+
+	if !c.changed(point(68.5), start) {
+		t.Error("first point not written")
+	}
+	c.record([]*influxclient.Point{point(68.5)}, start)
+	if c.changed(point(68.5), start.Add(3*time.Minute)) {
+		t.Error("unchanged point written")
+	}
+	if !c.changed(point(69), start.Add(3*time.Minute)) {
+		t.Error("changed point not written")
+	}
+	if !c.changed(point(68.5), start.Add(time.Hour)) {
+		t.Error("heartbeat not written")
+	}
+}
+
+func TestCurrentStatePollerChangedOnly(t *testing.T) {
+	server := newInfluxServer(t)
+	sensor := func(temp string) []ecobee.RemoteSensor {
+		return []ecobee.RemoteSensor{{
+			ID:         "rs:100",
+			Name:       "Bedroom",
+			Capability: []ecobee.RemoteSensorCapability{{Type: "temperature", Value: temp}},
+		}}
+	}
+	client := &fakeEcobeeClient{
+		thermostats: []ecobee.Thermostat{{Identifier: "123", Name: "Main", RemoteSensors: sensor("685")}},
+	}
+	u := newTestUpdater(t, Config{ThermostatID: "123", WriteSensors: true}, client, server)
+	p := newCurrentStatePoller(u.config, client, u.influxClient, newChangeTracker(time.Hour))
+
+	ctx := context.Background()
+	for _, temp := range []string{"685", "685", "690", "690"} {
+		client.thermostats[0].RemoteSensors = sensor(temp)
+		if err := p.poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := server.written(); len(lines) != 2 {
+		t.Errorf("wrote %d points for 2 distinct readings: %q", len(lines), lines)
+	}
+}
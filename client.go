@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// EcobeeClient is the part of the ecobee API that updates read from.
+// *ecobee.Client implements it against the real API.
+type EcobeeClient interface {
+	GetThermostats(ctx context.Context, selection ecobee.Selection) ([]ecobee.Thermostat, error)
+	GetThermostatSummary(ctx context.Context, selection ecobee.Selection) (map[string]ecobee.ThermostatSummary, error)
+	GetRuntimeReport(ctx context.Context, thermostatID, startDate, endDate string,
+		writeHumidifier, writeAuxHeat1, writeAuxHeat2, writeHeatPump1, writeHeatPump2, writeCool1, writeCool2 bool,
+		extraColumns []string) (map[string]interface{}, error)
+	GetRuntimeReportJob(ctx context.Context, thermostatID, startDate, endDate string,
+		writeHumidifier, writeAuxHeat1, writeAuxHeat2, writeHeatPump1, writeHeatPump2, writeCool1, writeCool2 bool,
+		extraColumns []string) (map[string]interface{}, error)
+}
+
+var _ EcobeeClient = (*ecobee.Client)(nil)
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avast/retry-go"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// fakeEcobeeClient is an in-memory EcobeeClient. Every call returns the
+// canned data for the thermostats it asks about, regardless of dates or
+// columns, or err if it is set.
+type fakeEcobeeClient struct {
+	thermostats []ecobee.Thermostat
+	summary     map[string]ecobee.ThermostatSummary
+	reports     map[string][]ecobee.RuntimeReportDataEntry
+	err         error
+}
+
+var _ EcobeeClient = (*fakeEcobeeClient)(nil)
+
+// matches reports whether id is one of the thermostats selection asks for.
+func (f *fakeEcobeeClient) matches(selection ecobee.Selection, id string) bool {
+	if selection.SelectionType != "thermostats" {
+		return true
+	}
+	for _, want := range strings.Split(selection.SelectionMatch, ",") {
+		if want == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeEcobeeClient) GetThermostats(ctx context.Context, selection ecobee.Selection) ([]ecobee.Thermostat, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var ts []ecobee.Thermostat
+	for _, t := range f.thermostats {
+		if f.matches(selection, t.Identifier) {
+			ts = append(ts, t)
+		}
+	}
+	return ts, nil
+}
+
+func (f *fakeEcobeeClient) GetThermostatSummary(ctx context.Context, selection ecobee.Selection) (map[string]ecobee.ThermostatSummary, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	summary := map[string]ecobee.ThermostatSummary{}
+	for id, s := range f.summary {
+		if f.matches(selection, id) {
+			summary[id] = s
+		}
+	}
+	return summary, nil
+}
+
+func (f *fakeEcobeeClient) GetRuntimeReport(ctx context.Context, thermostatID, startDate, endDate string,
+	writeHumidifier, writeAuxHeat1, writeAuxHeat2, writeHeatPump1, writeHeatPump2, writeCool1, writeCool2 bool,
+	extraColumns []string) (map[string]interface{}, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	reportData := map[string]interface{}{}
+	for _, id := range strings.Split(thermostatID, ",") {
+		if entries, ok := f.reports[id]; ok {
+			reportData[id] = entries
+		}
+	}
+	return reportData, nil
+}
+
+func (f *fakeEcobeeClient) GetRuntimeReportJob(ctx context.Context, thermostatID, startDate, endDate string,
+	writeHumidifier, writeAuxHeat1, writeAuxHeat2, writeHeatPump1, writeHeatPump2, writeCool1, writeCool2 bool,
+	extraColumns []string) (map[string]interface{}, error) {
+	return f.GetRuntimeReport(ctx, thermostatID, startDate, endDate,
+		writeHumidifier, writeAuxHeat1, writeAuxHeat2, writeHeatPump1, writeHeatPump2, writeCool1, writeCool2,
+		extraColumns)
+}
+
+// influxServer is a mock InfluxDB 1.x or 2.x server that records the line
+// protocol written to it.
+type influxServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	lines    []string
+	fail     bool
+	failNext int // requests to fail before succeeding again
+	requests int
+}
+
+func newInfluxServer(t *testing.T) *influxServer {
+	s := &influxServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/write" && r.URL.Path != "/api/v2/write" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		if s.failNext > 0 {
+			s.failNext--
+			http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		if s.fail {
+			http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			s.lines = append(s.lines, line)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *influxServer) written() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+// newTestUpdater returns an updater that reads from client and writes to
+// server, without retrying.
+func newTestUpdater(t *testing.T, config Config, client EcobeeClient, server *influxServer) *updater {
+	config.InfluxServer = server.URL
+	if config.InfluxDatabase == "" {
+		config.InfluxDatabase = "ecobee"
+	}
+	w, err := newInfluxWriter(config, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUpdater(config, client, w)
+	u.retryOpts = []retry.Option{retry.Attempts(1)}
+	u.writeOpts.attempts = 1
+	return u
+}
+
+func TestDoUpdate(t *testing.T) {
+	server := newInfluxServer(t)
+	client := &fakeEcobeeClient{
+		thermostats: []ecobee.Thermostat{
+			{Identifier: "123", Name: "Main Floor", ModelNumber: "nikeSmart", Brand: "ecobee"},
+		},
+		reports: map[string][]ecobee.RuntimeReportDataEntry{
+			"123": {{
+				ReportTime:     time.Date(2023, 1, 2, 13, 0, 0, 0, time.UTC),
+				ThermostatTime: time.Date(2023, 1, 2, 8, 0, 0, 0, time.UTC),
+				DataFields:     map[string]string{"zoneAveTemp": "70.5", "zoneHumidity": "45"},
+			}},
+		},
+	}
+	u := newTestUpdater(t, Config{ThermostatID: "123"}, client, server)
+
+	if err := u.doUpdate(context.Background(), "2023-01-02", "2023-01-02"); err != nil {
+		t.Fatalf("doUpdate: %v", err)
+	}
+
+	want := []string{
+		`ecobee_runtime_report,device_id=ecobee-123,receiver=ecobee-influx-connector,thermostat_brand=ecobee,thermostat_model=nikeSmart,thermostat_name=Main\ Floor humidity_%=45,temperature_°F=70.5 1672664400000000000`,
+	}
+	got := server.written()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("written:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDoUpdateWriteFailure(t *testing.T) {
+	server := newInfluxServer(t)
+	server.fail = true
+	client := &fakeEcobeeClient{
+		reports: map[string][]ecobee.RuntimeReportDataEntry{
+			"123": {{
+				ReportTime: time.Date(2023, 1, 2, 13, 0, 0, 0, time.UTC),
+				DataFields: map[string]string{"zoneAveTemp": "70.5"},
+			}},
+		},
+	}
+	u := newTestUpdater(t, Config{ThermostatID: "123"}, client, server)
+
+	if err := u.doUpdate(context.Background(), "2023-01-02", "2023-01-02"); err == nil {
+		t.Fatal("doUpdate succeeded with Influx failing")
+	}
+}
+
+// recordingPublisher records the thermostat of every row published.
+type recordingPublisher struct {
+	thermostats []string
+}
+
+func (p *recordingPublisher) publishRuntime(thermostatID string, t time.Time, fields map[string]interface{}) error {
+	p.thermostats = append(p.thermostats, thermostatID)
+	return nil
+}
+
+func TestDoUpdatePublishesAfterWrite(t *testing.T) {
+	server := newInfluxServer(t)
+	client := &fakeEcobeeClient{
+		reports: map[string][]ecobee.RuntimeReportDataEntry{
+			"123": {{
+				ReportTime: time.Date(2023, 1, 2, 13, 0, 0, 0, time.UTC),
+				DataFields: map[string]string{"zoneAveTemp": "70.5"},
+			}},
+		},
+	}
+	u := newTestUpdater(t, Config{ThermostatID: "123"}, client, server)
+	publisher := &recordingPublisher{}
+	u.publisher = publisher
+	u.retryOpts = []retry.Option{retry.Attempts(2), retry.Delay(time.Millisecond)}
+
+	// Rows that never reached Influx aren't published.
+	server.fail = true
+	if err := u.doUpdate(context.Background(), "2023-01-02", "2023-01-02"); err == nil {
+		t.Fatal("doUpdate succeeded with Influx failing")
+	}
+	if len(publisher.thermostats) != 0 {
+		t.Errorf("published %v after a failed write, want nothing", publisher.thermostats)
+	}
+
+	// The first attempt fails and the second succeeds, and the row is
+	// published once.
+	server.fail = false
+	server.failNext = 1
+	if err := u.doUpdate(context.Background(), "2023-01-02", "2023-01-02"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"123"}; strings.Join(publisher.thermostats, ",") != strings.Join(want, ",") {
+		t.Errorf("published %v, want %v", publisher.thermostats, want)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// Validate checks the config for every problem it can find without
+// contacting ecobee or Influx, so they can all be fixed at once.
+func (c Config) Validate() []error {
+	var errs []error
+
+	if c.APIKey == "" {
+		errs = append(errs, fmt.Errorf("api_key must be set"))
+	}
+	if c.ThermostatID == "" && c.ThermostatNameFilter == "" {
+		errs = append(errs, fmt.Errorf("thermostat_id or thermostat_name_filter must be set"))
+	}
+	if c.ThermostatNameFilter != "" {
+		if _, err := regexp.Compile(c.ThermostatNameFilter); err != nil {
+			errs = append(errs, fmt.Errorf("invalid thermostat_name_filter: %v", err))
+		}
+	}
+	if len(c.ExtraRuntimeColumns) > 0 {
+		if _, err := ecobee.NormalizeRuntimeReportColumns(c.ExtraRuntimeColumns); err != nil {
+			errs = append(errs, fmt.Errorf("invalid extra_runtime_columns: %v", err))
+		}
+	}
+	for k := range c.StaticTags {
+		for _, reserved := range reservedTags {
+			if k == reserved {
+				errs = append(errs, fmt.Errorf("invalid static_tags: %q is set by the connector", k))
+			}
+		}
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("invalid log_format %q: must be \"text\" or \"json\"", c.LogFormat))
+	}
+	if c.Units != "" && c.Units != "imperial" && c.Units != "metric" {
+		errs = append(errs, fmt.Errorf("invalid units %q: must be \"imperial\" or \"metric\"", c.Units))
+	}
+	if c.FieldNameStyle != "" && c.FieldNameStyle != "unicode" && c.FieldNameStyle != "ascii" {
+		errs = append(errs, fmt.Errorf("invalid field_name_style %q: must be \"unicode\" or \"ascii\"", c.FieldNameStyle))
+	}
+
+	if len(c.InfluxTargets) > 0 {
+		if c.InfluxServer != "" {
+			log.Printf("Warning: influx_server and the other top-level influx_* fields are ignored when influx_targets is set.")
+		}
+		for i, target := range c.InfluxTargets {
+			for _, err := range target.validate() {
+				errs = append(errs, fmt.Errorf("influx_targets[%d]: %v", i, err))
+			}
+		}
+	} else {
+		errs = append(errs, c.influxTargets()[0].validate()...)
+	}
+	if c.InfluxMaxPointsPerWrite < 0 {
+		errs = append(errs, fmt.Errorf("invalid influx_max_points_per_write %d: must not be negative", c.InfluxMaxPointsPerWrite))
+	}
+	for _, option := range []struct {
+		name  string
+		value int
+	}{
+		{"influx_v2_batch_size", c.InfluxV2BatchSize},
+		{"influx_v2_flush_interval_ms", c.InfluxV2FlushIntervalMs},
+		{"influx_v2_max_retries", c.InfluxV2MaxRetries},
+	} {
+		if option.value < 0 {
+			errs = append(errs, fmt.Errorf("invalid %s %d: must not be negative", option.name, option.value))
+		} else if option.value > 0 && !c.influxV2() {
+			log.Printf("Warning: %s is ignored unless every Influx target has influx_version 2.", option.name)
+		}
+	}
+	if c.EcobeeAPIURL != "" {
+		if u, err := url.Parse(c.EcobeeAPIURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid ecobee_api_url: %v", err))
+		} else if u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid ecobee_api_url %q: must be a URL like %s", c.EcobeeAPIURL, ecobee.DefaultBaseURL))
+		}
+	}
+
+	for _, proxy := range []struct {
+		name, value string
+	}{
+		{"http_proxy", c.HTTPProxy},
+		{"https_proxy", c.HTTPSProxy},
+	} {
+		if proxy.value == "" {
+			continue
+		}
+		if u, err := url.Parse(proxy.value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %v", proxy.name, err))
+		} else if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be a URL like http://proxy:3128 or socks5://proxy:1080", proxy.name, proxy.value))
+		}
+	}
+
+	if c.InitialStartDate != "" {
+		if _, err := time.Parse("2006-01-02", c.InitialStartDate); err != nil {
+			errs = append(errs, fmt.Errorf("invalid initial_start_date %q: must be a date like 2006-01-02", c.InitialStartDate))
+		}
+	}
+
+	durations := []struct {
+		name  string
+		value string
+	}{
+		{"influx_timeout", c.InfluxTimeout},
+		{"poll_interval", c.PollInterval},
+		{"catch_up_interval", c.CatchUpInterval},
+		{"catch_up_jitter", c.CatchUpJitter},
+		{"live_interval", c.LiveInterval},
+		{"metadata_refresh_interval", c.MetadataRefreshInterval},
+		{"equipment_status_interval", c.EquipmentStatusInterval},
+		{"current_state_interval", c.CurrentStateInterval},
+		{"heartbeat_interval", c.HeartbeatInterval},
+		{"retry_initial_delay", c.RetryInitialDelay},
+		{"retry_max_delay", c.RetryMaxDelay},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d.value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %v", d.name, err))
+		}
+	}
+
+	return errs
+}
+
+// validate checks one Influx target's settings.
+func (t InfluxTarget) validate() []error {
+	var errs []error
+
+	if t.Server == "" {
+		errs = append(errs, fmt.Errorf("influx_server must be set"))
+	} else if u, err := url.Parse(t.Server); err != nil {
+		errs = append(errs, fmt.Errorf("invalid influx_server: %v", err))
+	} else if u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("invalid influx_server %q: must be a URL like http://localhost:8086", t.Server))
+	}
+	if t.Version == "2" {
+		if t.Org == "" || t.Bucket == "" || t.Token == "" {
+			errs = append(errs, fmt.Errorf("influx_org, influx_bucket, and influx_token must be set for influx_version 2"))
+		}
+		if t.User != "" || t.Pass != "" || t.Database != "" {
+			log.Printf("Warning: influx_user, influx_password, and influx_database are ignored with influx_version 2.")
+		}
+	} else {
+		if t.Database == "" {
+			errs = append(errs, fmt.Errorf("influx_database must be set"))
+		}
+		if t.Org != "" || t.Bucket != "" || t.Token != "" {
+			log.Printf("Warning: influx_org, influx_bucket, and influx_token are ignored unless influx_version is 2.")
+		}
+	}
+
+	return errs
+}
+
+// ThermostatConfig is one entry of thermostat_id when it is given as a list:
+// a thermostat ID and the write_* settings that differ from the top-level ones
+// for that thermostat's equipment. Settings left out use the top-level value.
+type ThermostatConfig struct {
+	ID              string `json:"id"`
+	WriteHeatPump1  *bool  `json:"write_heat_pump_1,omitempty"`
+	WriteHeatPump2  *bool  `json:"write_heat_pump_2,omitempty"`
+	WriteAuxHeat1   *bool  `json:"write_aux_heat_1,omitempty"`
+	WriteAuxHeat2   *bool  `json:"write_aux_heat_2,omitempty"`
+	WriteCool1      *bool  `json:"write_cool_1,omitempty"`
+	WriteCool2      *bool  `json:"write_cool_2,omitempty"`
+	WriteHumidifier *bool  `json:"write_humidifier,omitempty"`
+}
+
+// UnmarshalJSON reads the config, accepting thermostat_id either as a
+// comma-separated string or as a list whose entries are IDs or
+// ThermostatConfig objects. A list is stored in Thermostats, with
+// ThermostatID set to its IDs joined by commas.
+func (c *Config) UnmarshalJSON(b []byte) error {
+	type plainConfig Config
+	aux := struct {
+		*plainConfig
+		ThermostatID json.RawMessage `json:"thermostat_id"`
+	}{plainConfig: (*plainConfig)(c)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if len(aux.ThermostatID) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(aux.ThermostatID, &c.ThermostatID); err == nil {
+		return nil
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(aux.ThermostatID, &entries); err != nil {
+		return fmt.Errorf("thermostat_id must be a string or a list")
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		var t ThermostatConfig
+		if err := json.Unmarshal(entry, &t.ID); err != nil {
+			if err := json.Unmarshal(entry, &t); err != nil {
+				return fmt.Errorf("invalid thermostat_id entry %s: %v", entry, err)
+			}
+		}
+		if t.ID == "" {
+			return fmt.Errorf("invalid thermostat_id entry %s: id must be set", entry)
+		}
+		ids = append(ids, t.ID)
+		c.Thermostats = append(c.Thermostats, t)
+	}
+	c.ThermostatID = strings.Join(ids, ",")
+	return nil
+}
+
+// runtimeColumns are the write_* settings that choose the columns requested
+// in a runtime report.
+type runtimeColumns struct {
+	HeatPump1, HeatPump2 bool
+	AuxHeat1, AuxHeat2   bool
+	Cool1, Cool2         bool
+	Humidifier           bool
+}
+
+// runtimeReportGroup is a set of thermostats that need the same columns, so
+// they can share runtime report requests.
+type runtimeReportGroup struct {
+	columns       runtimeColumns
+	thermostatIDs string
+}
+
+// runtimeColumnsFor returns the write_* settings for thermostat id, with its
+// entry in Thermostats, if any, applied over the top-level ones.
+func (c Config) runtimeColumnsFor(id string) runtimeColumns {
+	cols := runtimeColumns{
+		HeatPump1:  c.WriteHeatPump1,
+		HeatPump2:  c.WriteHeatPump2,
+		AuxHeat1:   c.WriteAuxHeat1,
+		AuxHeat2:   c.WriteAuxHeat2,
+		Cool1:      c.WriteCool1,
+		Cool2:      c.WriteCool2,
+		Humidifier: c.WriteHumidifier,
+	}
+	for _, t := range c.Thermostats {
+		if t.ID != id {
+			continue
+		}
+		overrides := []struct {
+			value *bool
+			col   *bool
+		}{
+			{t.WriteHeatPump1, &cols.HeatPump1},
+			{t.WriteHeatPump2, &cols.HeatPump2},
+			{t.WriteAuxHeat1, &cols.AuxHeat1},
+			{t.WriteAuxHeat2, &cols.AuxHeat2},
+			{t.WriteCool1, &cols.Cool1},
+			{t.WriteCool2, &cols.Cool2},
+			{t.WriteHumidifier, &cols.Humidifier},
+		}
+		for _, o := range overrides {
+			if o.value != nil {
+				*o.col = *o.value
+			}
+		}
+	}
+	return cols
+}
+
+// runtimeReportGroups splits the comma-separated thermostatIDs into groups
+// that need the same columns, in the order they first appear. Without
+// per-thermostat settings there is just one group.
+func (c Config) runtimeReportGroups(thermostatIDs string) []runtimeReportGroup {
+	groups := []runtimeReportGroup{}
+	index := map[runtimeColumns]int{}
+	for _, id := range strings.Split(thermostatIDs, ",") {
+		cols := c.runtimeColumnsFor(id)
+		i, ok := index[cols]
+		if !ok {
+			i = len(groups)
+			index[cols] = i
+			groups = append(groups, runtimeReportGroup{columns: cols})
+		}
+		if groups[i].thermostatIDs != "" {
+			groups[i].thermostatIDs += ","
+		}
+		groups[i].thermostatIDs += id
+	}
+	return groups
+}
+
+// loadEnv overrides config fields with the environment variables named by
+// their `env` struct tags, so secrets don't have to be kept in the config
+// file. Variables that are unset are ignored.
+func (c *Config) loadEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+			f.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+			f.SetInt(int64(n))
+		default:
+			return fmt.Errorf("%s: unsupported config field type %s", name, f.Type())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// counterTracker converts cumulative counter fields into per-interval deltas.
+// It remembers the previous value of each configured field per thermostat,
+// so entries must be applied in time order.
+type counterTracker struct {
+	mu       sync.Mutex
+	fields   map[string]bool
+	previous map[string]map[string]float64
+}
+
+func newCounterTracker(fields []string) *counterTracker {
+	c := &counterTracker{
+		fields:   map[string]bool{},
+		previous: map[string]map[string]float64{},
+	}
+	for _, f := range fields {
+		c.fields[f] = true
+	}
+	return c
+}
+
+// clone returns a copy of c. An update works on a copy and only keeps it once
+// everything has been written, so a retried update starts from the same
+// previous values as the attempt that failed.
+func (c *counterTracker) clone() *counterTracker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := &counterTracker{
+		fields:   c.fields,
+		previous: make(map[string]map[string]float64, len(c.previous)),
+	}
+	for id, previous := range c.previous {
+		p := make(map[string]float64, len(previous))
+		for name, v := range previous {
+			p[name] = v
+		}
+		n.previous[id] = p
+	}
+	return n
+}
+
+// apply replaces each counter field in `fields` with the change since the
+// previous interval for the same thermostat. A value lower than the previous
+// one means the counter was reset (e.g. at midnight), so the new value is the
+// delta. A field seen for the first time has no delta and is removed.
+func (c *counterTracker) apply(thermostatID string, fields map[string]interface{}) {
+	if len(c.fields) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous, ok := c.previous[thermostatID]
+	if !ok {
+		previous = map[string]float64{}
+		c.previous[thermostatID] = previous
+	}
+
+	for name := range c.fields {
+		val, ok := fields[name]
+		if !ok {
+			continue
+		}
+
+		var cur float64
+		switch v := val.(type) {
+		case int:
+			cur = float64(v)
+		case float64:
+			cur = v
+		default:
+			continue
+		}
+
+		prev, seen := previous[name]
+		previous[name] = cur
+		if !seen {
+			delete(fields, name)
+			continue
+		}
+
+		delta := cur - prev
+		if cur < prev {
+			delta = cur
+		}
+		if _, isInt := val.(int); isInt {
+			fields[name] = int(delta)
+		} else {
+			fields[name] = delta
+		}
+	}
+}
+
+// dailyRuntimeTotals adds a running total for the day to each equipment
+// runtime field, restarting at midnight thermostat time. Entries must be
+// applied in time order.
+type dailyRuntimeTotals struct {
+	mu     sync.Mutex
+	day    map[string]string
+	totals map[string]map[string]int
+}
+
+func newDailyRuntimeTotals() *dailyRuntimeTotals {
+	return &dailyRuntimeTotals{
+		day:    map[string]string{},
+		totals: map[string]map[string]int{},
+	}
+}
+
+// clone returns a copy of d, for the same reason as counterTracker.clone.
+func (d *dailyRuntimeTotals) clone() *dailyRuntimeTotals {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := newDailyRuntimeTotals()
+	for id, day := range d.day {
+		n.day[id] = day
+	}
+	for id, totals := range d.totals {
+		t := make(map[string]int, len(totals))
+		for name, v := range totals {
+			t[name] = v
+		}
+		n.totals[id] = t
+	}
+	return n
+}
+
+// apply adds a `*_run_time_cumulative_s` field for every `*_run_time_s` field
+// in `fields`, for the interval starting at thermostatTime.
+func (d *dailyRuntimeTotals) apply(thermostatID string, thermostatTime time.Time, fields map[string]interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	day := thermostatTime.Format("2006-01-02")
+	if d.day[thermostatID] != day {
+		d.day[thermostatID] = day
+		d.totals[thermostatID] = map[string]int{}
+	}
+	totals := d.totals[thermostatID]
+
+	for name, val := range fields {
+		seconds, ok := val.(int)
+		if !ok || !strings.HasSuffix(name, "_run_time_s") {
+			continue
+		}
+		totals[name] += seconds
+		fields[strings.TrimSuffix(name, "_s")+"_cumulative_s"] = totals[name]
+	}
+}
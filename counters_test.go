@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+func TestCounterTrackerReset(t *testing.T) {
+	c := newCounterTracker([]string{"fan_run_time_s"})
+	var got []interface{}
+	for _, v := range []int{100, 150, 30, 50} {
+		fields := map[string]interface{}{"fan_run_time_s": v, "temperature_°F": 70.0}
+		c.apply("123", fields)
+		got = append(got, fields["fan_run_time_s"])
+	}
+	// The first value has nothing to compare to, and 30 is lower than 150, so
+	// the counter was reset and 30 is the delta.
+	want := []interface{}{nil, 50, 30, 20}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deltas = %v, want %v", got, want)
+	}
+}
+
+func TestCounterTrackerClone(t *testing.T) {
+	c := newCounterTracker([]string{"fan_run_time_s"})
+	c.apply("123", map[string]interface{}{"fan_run_time_s": 100})
+
+	attempt := c.clone()
+	attempt.apply("123", map[string]interface{}{"fan_run_time_s": 150})
+
+	fields := map[string]interface{}{"fan_run_time_s": 150}
+	c.apply("123", fields)
+	if got := fields["fan_run_time_s"]; got != 50 {
+		t.Errorf("delta after a discarded clone = %v, want 50", got)
+	}
+}
+
+// A window that fails to write and is retried must give the same deltas as
+// if it had been written the first time.
+func TestDoUpdateRetryCounters(t *testing.T) {
+	server := newInfluxServer(t)
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	row := func(minutes int, auxHeat string) ecobee.RuntimeReportDataEntry {
+		ts := day.Add(time.Duration(minutes) * time.Minute)
+		return ecobee.RuntimeReportDataEntry{
+			ReportTime:     ts,
+			ThermostatTime: ts,
+			DataFields:     map[string]string{"auxHeat1": auxHeat},
+		}
+	}
+	client := &fakeEcobeeClient{
+		reports: map[string][]ecobee.RuntimeReportDataEntry{
+			"123": {row(0, "100"), row(5, "150")},
+		},
+	}
+	u := newTestUpdater(t, Config{ThermostatID: "123", CounterFields: []string{"aux_heat_1_run_time_s"}}, client, server)
+	ctx := context.Background()
+
+	if err := u.doUpdate(ctx, "2023-01-02", "2023-01-02"); err != nil {
+		t.Fatal(err)
+	}
+
+	client.reports["123"] = []ecobee.RuntimeReportDataEntry{row(10, "170"), row(15, "200")}
+	server.fail = true
+	if err := u.doUpdate(ctx, "2023-01-03", "2023-01-03"); err == nil {
+		t.Fatal("doUpdate succeeded with Influx failing")
+	}
+	server.fail = false
+	if err := u.doUpdate(ctx, "2023-01-03", "2023-01-03"); err != nil {
+		t.Fatal(err)
+	}
+
+	var fields []string
+	for _, line := range server.written() {
+		fields = append(fields, strings.Fields(line)[1])
+	}
+	want := []string{"aux_heat_1_run_time_s=50i", "aux_heat_1_run_time_s=20i", "aux_heat_1_run_time_s=30i"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("written fields = %v, want %v", fields, want)
+	}
+}
+
+func TestDailyRuntimeTotalsMidnight(t *testing.T) {
+	d := newDailyRuntimeTotals()
+	var got []interface{}
+	for _, row := range []struct {
+		time    string
+		seconds int
+	}{
+		{"2023-01-02 23:50:00", 100},
+		{"2023-01-02 23:55:00", 200},
+		{"2023-01-03 00:00:00", 50},
+		{"2023-01-03 00:05:00", 25},
+	} {
+		ts, _ := time.Parse("2006-01-02 15:04:05", row.time)
+		fields := map[string]interface{}{"fan_run_time_s": row.seconds}
+		d.apply("123", ts, fields)
+		got = append(got, fields["fan_run_time_cumulative_s"])
+	}
+	want := []interface{}{100, 300, 50, 75}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("totals = %v, want %v", got, want)
+	}
+}
+
+func TestDoUpdateRetryDailyTotals(t *testing.T) {
+	server := newInfluxServer(t)
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	row := func(minutes int, auxHeat string) ecobee.RuntimeReportDataEntry {
+		ts := day.Add(time.Duration(minutes) * time.Minute)
+		return ecobee.RuntimeReportDataEntry{
+			ReportTime:     ts,
+			ThermostatTime: ts,
+			DataFields:     map[string]string{"auxHeat1": auxHeat},
+		}
+	}
+	client := &fakeEcobeeClient{
+		reports: map[string][]ecobee.RuntimeReportDataEntry{
+			"123": {row(0, "100"), row(5, "200")},
+		},
+	}
+	u := newTestUpdater(t, Config{ThermostatID: "123", WriteCumulativeRuntime: true}, client, server)
+	ctx := context.Background()
+
+	server.fail = true
+	if err := u.doUpdate(ctx, "2023-01-02", "2023-01-02"); err == nil {
+		t.Fatal("doUpdate succeeded with Influx failing")
+	}
+	server.fail = false
+	if err := u.doUpdate(ctx, "2023-01-02", "2023-01-02"); err != nil {
+		t.Fatal(err)
+	}
+
+	var fields []string
+	for _, line := range server.written() {
+		fields = append(fields, strings.Fields(line)[1])
+	}
+	want := []string{
+		"aux_heat_1_run_time_cumulative_s=100i,aux_heat_1_run_time_s=100i",
+		"aux_heat_1_run_time_cumulative_s=300i,aux_heat_1_run_time_s=200i",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("written fields = %v, want %v", fields, want)
+	}
+}
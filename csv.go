@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+)
+
+// csvWriter collects the `ecobee_runtime_report` points that would have been
+// written to Influx, for -dump-csv. Other measurements are dropped.
+type csvWriter struct {
+	mu     sync.Mutex
+	points []*influxclient.Point
+}
+
+func (w *csvWriter) Write(bp influxclient.BatchPoints) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, pt := range bp.Points() {
+		if pt.Name() == "ecobee_runtime_report" {
+			w.points = append(w.points, pt)
+		}
+	}
+	return nil
+}
+
+// save writes the collected points to file in time order, one per row. The
+// header is `time` followed by every tag and then every field name seen.
+// Values a point doesn't have are left empty.
+func (w *csvWriter) save(file string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sort.SliceStable(w.points, func(i, j int) bool {
+		return w.points[i].Time().Before(w.points[j].Time())
+	})
+
+	tagSet := map[string]bool{}
+	fieldSet := map[string]bool{}
+	rows := make([]map[string]interface{}, len(w.points))
+	for i, pt := range w.points {
+		fields, err := pt.Fields()
+		if err != nil {
+			return err
+		}
+		for k := range fields {
+			fieldSet[k] = true
+		}
+		for k := range pt.Tags() {
+			tagSet[k] = true
+		}
+		rows[i] = fields
+	}
+	tags := sortedKeys(tagSet)
+	fields := sortedKeys(fieldSet)
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	out := csv.NewWriter(f)
+	out.Write(append(append([]string{"time"}, tags...), fields...))
+	for i, pt := range w.points {
+		record := []string{pt.Time().UTC().Format(time.RFC3339)}
+		for _, k := range tags {
+			record = append(record, pt.Tags()[k])
+		}
+		for _, k := range fields {
+			v, ok := rows[i][k]
+			if !ok {
+				record = append(record, "")
+				continue
+			}
+			record = append(record, fmt.Sprint(v))
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
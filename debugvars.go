@@ -0,0 +1,32 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// Counters and progress served by expvar on debug_vars_listen, for a quick
+// look at what the connector is doing without running Prometheus. The
+// counters are the same as the Prometheus metrics.
+var (
+	debugAPIErrors         = expvar.NewInt("api_errors_total")
+	debugInfluxWriteErrors = expvar.NewInt("influx_write_errors_total")
+	debugPointsWritten     = expvar.NewInt("points_written_total")
+	debugLastSuccess       = expvar.NewString("last_success")
+	debugStartDate         = expvar.NewString("current_start_date")
+	debugEndDate           = expvar.NewString("current_end_date")
+	debugLastData          = expvar.NewString("last_data")
+)
+
+// serveDebugVars serves the expvar variables at /debug/vars on addr in the
+// background.
+func serveDebugVars(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Unable to serve debug vars on %s: %s", addr, err)
+		}
+	}()
+}
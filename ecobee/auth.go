@@ -22,8 +22,10 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/glog"
 	"golang.org/x/oauth2"
 )
 
@@ -35,6 +37,10 @@ var Scopes = []string{"smartRead", "smartWrite"}
 type tokenSource struct {
 	token               oauth2.Token
 	cacheFile, clientID string
+
+	// client sends the authorization requests. If nil, http.DefaultClient
+	// is used.
+	client *http.Client
 }
 
 func TokenSource(clientID, cacheFile string) oauth2.TokenSource {
@@ -57,6 +63,13 @@ func newTokenSource(clientID, cacheFile string) *tokenSource {
 	return &tokenSource{clientID: clientID, cacheFile: cacheFile, token: tok}
 }
 
+func (ts *tokenSource) httpClient() *http.Client {
+	if ts.client != nil {
+		return ts.client
+	}
+	return http.DefaultClient
+}
+
 func (ts *tokenSource) save() error {
 	d, err := json.Marshal(ts.token)
 	if err != nil {
@@ -69,6 +82,10 @@ func (ts *tokenSource) save() error {
 type PinResponse struct {
 	EcobeePin string `json:"ecobeePin"`
 	Code      string `json:"code"`
+	// ExpiresIn is how many minutes the PIN is valid for, and Interval how
+	// many seconds to wait between token requests while waiting for it.
+	ExpiresIn int `json:"expires_in"`
+	Interval  int `json:"interval"`
 }
 
 // Interactive authentication, triggered on initial use of the client
@@ -98,7 +115,7 @@ func (ts *tokenSource) authorize() (*PinResponse, error) {
 		RawQuery: uv.Encode(),
 	}
 
-	resp, err := http.Get(u.String())
+	resp, err := ts.httpClient().Get(u.String())
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving response: %s", err)
 	}
@@ -161,11 +178,15 @@ func (ts *tokenSource) getToken(uv url.Values) error {
 		Path:     "token",
 		RawQuery: uv.Encode(),
 	}
-	resp, err := http.PostForm(u.String(), nil)
+	resp, err := ts.httpClient().PostForm(u.String(), nil)
 	if err != nil {
 		return fmt.Errorf("error POSTing request: %s", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		// The refresh token (or PIN code) was rejected.
+		return &AuthError{Message: fmt.Sprintf("token request rejected: %v", resp.Status)}
+	}
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("invalid server response: %v", resp.Status)
 	}
@@ -197,12 +218,12 @@ func (ts *tokenSource) Token() (*oauth2.Token, error) {
 		if len(ts.token.RefreshToken) > 0 {
 			err := ts.refreshToken()
 			if err != nil {
-				return nil, fmt.Errorf("error refreshing token: %s", err)
+				return nil, fmt.Errorf("error refreshing token: %w", err)
 			}
 		} else {
 			err := ts.firstAuth()
 			if err != nil {
-				return nil, fmt.Errorf("error on initial authentication: %s", err)
+				return nil, fmt.Errorf("error on initial authentication: %w", err)
 			}
 		}
 	}
@@ -212,15 +233,110 @@ func (ts *tokenSource) Token() (*oauth2.Token, error) {
 // Client represents the Ecobee API client.
 type Client struct {
 	*http.Client
+
+	// BaseURL is the root of the API, such as DefaultBaseURL.
+	BaseURL string
+
+	// Time zones of the thermostats seen so far, by thermostat ID.
+	locationsMu sync.Mutex
+	locations   map[string]*time.Location
+
+	// Requests wait until rateLimitedUntil after ecobee rate limits us.
+	rateLimitMu      sync.Mutex
+	rateLimitBackoff time.Duration
+	rateLimitedUntil time.Time
+
+	// files downloads report job files, which must not be sent the token.
+	files *http.Client
+
+	// warn logs problems with responses that aren't worth failing over.
+	warn Logger
 }
 
 // NewClient creates a Ecobee API client for the specific clientID
 // (Application Key).  Use the Ecobee Developer Portal to create the
 // Application Key.
 // (https://www.ecobee.com/consumerportal/index.html#/dev)
-func NewClient(clientID, cacheFile string) *Client {
-	return &Client{oauth2.NewClient(
-		context.Background(), TokenSource(clientID, cacheFile))}
+func NewClient(clientID, cacheFile string, opts ...ClientOption) *Client {
+	return newClient(oauth2.NewClient(
+		context.Background(), TokenSource(clientID, cacheFile)), opts)
+}
+
+// NewClientWithTransport is like NewClient, but API requests are sent through
+// the given transport (for example a RecordingTransport).
+func NewClientWithTransport(clientID, cacheFile string, transport http.RoundTripper, opts ...ClientOption) *Client {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+	return newClient(oauth2.NewClient(ctx, TokenSource(clientID, cacheFile)), opts)
+}
+
+// NewClientWithHTTPClient is like NewClient, but every request, including
+// authorization and report job downloads, is sent with httpClient. Use it to
+// set a timeout, custom TLS, or tracing, or to test against an httptest
+// server. httpClient's Transport is wrapped to add the token, and its Timeout,
+// CheckRedirect, and Jar are kept.
+func NewClientWithHTTPClient(clientID, cacheFile string, httpClient *http.Client, opts ...ClientOption) *Client {
+	ts := newTokenSource(clientID, cacheFile)
+	ts.client = httpClient
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	authed := oauth2.NewClient(ctx, oauth2.ReuseTokenSource(nil, ts))
+	authed.Timeout = httpClient.Timeout
+	authed.CheckRedirect = httpClient.CheckRedirect
+	authed.Jar = httpClient.Jar
+
+	c := newClient(authed, opts)
+	c.files = httpClient
+	return c
+}
+
+// NewReplayClient creates a client that answers every request from the
+// recordings in dir instead of contacting ecobee. No authentication is done.
+func NewReplayClient(dir string, opts ...ClientOption) *Client {
+	return newClient(&http.Client{Transport: &ReplayTransport{Dir: dir}}, opts)
+}
+
+// ClientOption changes how a Client is set up.
+type ClientOption func(*Client)
+
+// WithBaseURL sends API requests to baseURL (for example a proxy or a test
+// server) instead of DefaultBaseURL. Authorization still goes to ecobee.
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) {
+		c.BaseURL = baseURL
+	}
+}
+
+// Logger logs a message with key/value pairs.
+type Logger func(msg string, keyvals ...interface{})
+
+// WithLogger sends warnings, such as report rows that had to be skipped, to
+// logger instead of glog.
+func WithLogger(logger Logger) ClientOption {
+	return func(c *Client) {
+		c.warn = logger
+	}
+}
+
+// glogWarning is the Logger used without WithLogger.
+func glogWarning(msg string, keyvals ...interface{}) {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	glog.Warning(b.String())
+}
+
+func newClient(httpClient *http.Client, opts []ClientOption) *Client {
+	c := &Client{Client: httpClient, BaseURL: DefaultBaseURL, files: http.DefaultClient, warn: glogWarning}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// endpoint returns the URL of the API endpoint at path.
+func (c *Client) endpoint(path string) string {
+	return strings.TrimSuffix(c.BaseURL, "/") + "/" + path
 }
 
 // Authorize retrieves an ecobee Pin and Code, allowing calling code to present them to the user
@@ -231,6 +347,15 @@ func Authorize(clientID string) (*PinResponse, error) {
 	return newTokenSource(clientID, "").authorize()
 }
 
+// SaveRefreshToken exchanges a refresh token obtained elsewhere for a new
+// token and saves it to the auth cache, so a client can start without the
+// interactive PIN flow.
+func SaveRefreshToken(clientID, cacheFile, refreshToken string) error {
+	ts := &tokenSource{clientID: clientID, cacheFile: cacheFile}
+	ts.token.RefreshToken = refreshToken
+	return ts.refreshToken()
+}
+
 // SaveToken retreives a new token from ecobee and saves it to the auth cache
 // after a pin/code combination has been added by an ecobee user.
 func SaveToken(clientID string, cacheFile string, code string) error {
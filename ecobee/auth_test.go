@@ -0,0 +1,108 @@
+package ecobee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// redirectTransport sends every request to server, whatever its host, so
+// requests to api.ecobee.com can be answered by a test server.
+type redirectTransport struct {
+	server *httptest.Server
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.server.URL)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// expiredCredentials writes a credentials cache with an expired access token
+// and returns its path.
+func expiredCredentials(t *testing.T) string {
+	t.Helper()
+	file := path.Join(t.TempDir(), "ecobee-cred-cache")
+	b, err := json.Marshal(oauth2.Token{
+		AccessToken:  "old",
+		RefreshToken: "stale",
+		Expiry:       time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestRefreshRejected(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusBadRequest} {
+		apiRequests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				http.Error(w, `{"error":"invalid_grant"}`, status)
+				return
+			}
+			apiRequests++
+			fmt.Fprint(w, `{"thermostatList": [], "status": {"code": 0}}`)
+		}))
+
+		c := NewClientWithHTTPClient("key", expiredCredentials(t), &http.Client{Transport: redirectTransport{server}},
+			WithBaseURL(server.URL+"/1"), WithLogger(t.Logf))
+		_, err := c.GetThermostats(context.Background(), Selection{SelectionType: "registered"})
+		var authErr *AuthError
+		if !errors.As(err, &authErr) {
+			t.Errorf("refresh answered %d: error = %v, want an AuthError", status, err)
+		}
+		if apiRequests != 0 {
+			t.Errorf("refresh answered %d: sent %d API requests without a token", status, apiRequests)
+		}
+		server.Close()
+	}
+}
+
+func TestAPIUnauthorized(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		wantCode int
+	}{
+		{"401 with token expired", http.StatusUnauthorized, `{"status": {"code": 14, "message": "Authentication token has expired."}}`, 14},
+		{"401 with token deauthorized", http.StatusUnauthorized, `{"status": {"code": 16, "message": "Authentication token deauthorized."}}`, 16},
+		{"401 without a status", http.StatusUnauthorized, ``, 0},
+		{"500 with token expired", http.StatusInternalServerError, `{"status": {"code": 14, "message": "Authentication token has expired."}}`, 14},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+		c := newClient(server.Client(), []ClientOption{WithBaseURL(server.URL), WithLogger(t.Logf)})
+		_, err := c.GetThermostats(context.Background(), Selection{SelectionType: "registered"})
+		var authErr *AuthError
+		if !errors.As(err, &authErr) {
+			t.Errorf("%s: error = %v, want an AuthError", tt.name, err)
+		} else if authErr.Code != tt.wantCode {
+			t.Errorf("%s: code = %d, want %d", tt.name, authErr.Code, tt.wantCode)
+		}
+		server.Close()
+	}
+}
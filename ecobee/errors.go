@@ -0,0 +1,146 @@
+package ecobee
+
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// This file contains the error types returned by the client.
+
+// RateLimitError is returned when ecobee responds with HTTP 429. RetryAfter
+// is how long the server asked us to wait, or zero if it didn't say.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited, retry after %v", e.RetryAfter)
+	}
+	return "rate limited"
+}
+
+// ecobee status codes. See
+// https://www.ecobee.com/home/developer/api/documentation/v1/general/responses.shtml
+const (
+	StatusProcessingError       = 3
+	StatusInvalidRequestFormat  = 5
+	StatusTooManyThermostats    = 6
+	StatusValidationError       = 7
+	StatusInvalidFunction       = 8
+	StatusInvalidSelection      = 9
+	statusTokenExpired          = 14
+	StatusDuplicateDataViolated = 15
+	statusTokenDeauthorized     = 16
+)
+
+// APIError is returned when ecobee answers a request with a non-zero status
+// code, so callers can react to the specific Code.
+type APIError struct {
+	Code    int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api error %d: %s", e.Code, e.Message)
+}
+
+// statusError returns the error for a status from an API response, or nil if
+// the request succeeded.
+func statusError(s Status) error {
+	switch s.Code {
+	case 0:
+		return nil
+	case statusTokenExpired, statusTokenDeauthorized:
+		return &AuthError{Code: s.Code, Message: s.Message}
+	}
+	return &APIError{Code: s.Code, Message: s.Message}
+}
+
+// HTTPError is returned when ecobee answers with an HTTP error that carries
+// no status code of its own.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("invalid server response: %v", e.Status)
+}
+
+// AuthError is returned when ecobee rejects our credentials and retrying
+// won't help: the app has to be re-authorized with a new PIN.
+type AuthError struct {
+	// Code is ecobee's status code, or zero if there wasn't one.
+	Code    int
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("re-authorize required: %s (status %d)", e.Message, e.Code)
+	}
+	return fmt.Sprintf("re-authorize required: %s", e.Message)
+}
+
+// responseError converts a non-200 response into an error.
+func responseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	// Errors from the API carry a status with a more specific code.
+	var r struct {
+		Status Status `json:"status"`
+	}
+	if body, err := ioutil.ReadAll(resp.Body); err == nil {
+		_ = json.Unmarshal(body, &r)
+	}
+	switch {
+	case r.Status.Code == statusTokenExpired || r.Status.Code == statusTokenDeauthorized:
+		return &AuthError{Code: r.Status.Code, Message: r.Status.Message}
+	case resp.StatusCode == http.StatusUnauthorized:
+		return &AuthError{Code: r.Status.Code, Message: resp.Status}
+	case r.Status.Code != 0:
+		return &APIError{Code: r.Status.Code, Message: r.Status.Message}
+	}
+	return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. Anything unparseable is treated as zero.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -16,10 +16,14 @@ package ecobee
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -27,18 +31,72 @@ import (
 	"github.com/golang/glog"
 )
 
+// DefaultBaseURL is the ecobee API that clients talk to unless WithBaseURL
+// says otherwise.
+const DefaultBaseURL = `https://api.ecobee.com/1`
+
+// API endpoints, relative to the client's base URL.
 const (
-	thermostatAPIURL     = `https://api.ecobee.com/1/thermostat`
-	thermostatSummaryURL = `https://api.ecobee.com/1/thermostatSummary`
-	runtimeReportURL     = `https://api.ecobee.com/1/runtimeReport`
+	thermostatAPIURL     = `thermostat`
+	thermostatSummaryURL = `thermostatSummary`
+	runtimeReportURL     = `runtimeReport`
+
+	runtimeReportJobCreateURL = `runtimeReportJob/create`
+	runtimeReportJobStatusURL = `runtimeReportJob/status`
+
+	// The most thermostats a single runtime report request may select.
+	maxRuntimeReportThermostats = 25
+
+	// How often to check on a report job, and how long to wait before giving up.
+	reportJobPollInterval = 10 * time.Second
+	reportJobTimeout      = 30 * time.Minute
 )
 
+// RuntimeReportColumns are all of the columns the runtime report accepts.
+// Column names are case sensitive.
+var RuntimeReportColumns = []string{
+	"auxHeat1",
+	"auxHeat2",
+	"auxHeat3",
+	"compCool1",
+	"compCool2",
+	"compHeat1",
+	"compHeat2",
+	"dehumidifier",
+	"dmOffset",
+	"economizer",
+	"fan",
+	"humidifier",
+	"hvacMode",
+	"outdoorHumidity",
+	"outdoorTemp",
+	"sky",
+	"ventilator",
+	"wind",
+	"zoneAveTemp",
+	"zoneCalendarEvent",
+	"zoneClimate",
+	"zoneCoolTemp",
+	"zoneHeatTemp",
+	"zoneHumidity",
+	"zoneHumidityHigh",
+	"zoneHumidityLow",
+	"zoneHvacMode",
+	"zoneOccupancy",
+}
+
+// RuntimeReportDataEntry is one 5 minute interval of a runtime report. The API
+// always reports temperatures in Fahrenheit, whichever scale the thermostat
+// is set to display, so entries from different thermostats are comparable.
 type RuntimeReportDataEntry struct {
 	ReportTime time.Time
-	DataFields map[string]string
+	// ThermostatTime is the wall clock time at the thermostat. Its location
+	// is UTC, but only the date and time of day are meaningful.
+	ThermostatTime time.Time
+	DataFields     map[string]string
 }
 
-func (c *Client) UpdateThermostat(utr UpdateThermostatRequest) error {
+func (c *Client) UpdateThermostat(ctx context.Context, utr UpdateThermostatRequest) error {
 	j, err := json.Marshal(&utr)
 	if err != nil {
 		return fmt.Errorf("error marshaling json: %v", err)
@@ -46,19 +104,9 @@ func (c *Client) UpdateThermostat(utr UpdateThermostatRequest) error {
 
 	glog.V(1).Infof("UpdateThermostat request: %s", j)
 
-	// everything below here can be factored out into a common POST func
-	resp, err := c.Post(thermostatAPIURL, "application/json", bytes.NewReader(j))
-	if err != nil {
-		return fmt.Errorf("error on post request: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("invalid server response: %v", resp.Status)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := c.post(ctx, c.endpoint(thermostatAPIURL), j)
 	if err != nil {
-		return fmt.Errorf("error reading body: %v", err)
+		return fmt.Errorf("error updating thermostat: %w", err)
 	}
 
 	var s UpdateThermostatResponse
@@ -68,13 +116,10 @@ func (c *Client) UpdateThermostat(utr UpdateThermostatRequest) error {
 
 	glog.V(1).Infof("UpdateThermostat response: %+v", s)
 
-	if s.Status.Code == 0 {
-		return nil
-	}
-	return fmt.Errorf("API error: %s", s.Status.Message)
+	return statusError(s.Status)
 }
 
-func (c *Client) GetThermostat(thermostatID string) (*Thermostat, error) {
+func (c *Client) GetThermostat(ctx context.Context, thermostatID string) (*Thermostat, error) {
 	// TODO: Consider factoring the generation of Selection out into
 	// something else to make it more convenient to toggle the IncludeX
 	// flags?
@@ -91,7 +136,7 @@ func (c *Client) GetThermostat(thermostatID string) (*Thermostat, error) {
 		IncludeSensors:         true,
 		IncludeWeather:         true,
 	}
-	thermostats, err := c.GetThermostats(s)
+	thermostats, err := c.GetThermostats(ctx, s)
 	if err != nil {
 		return nil, err
 	} else if len(thermostats) != 1 {
@@ -100,7 +145,7 @@ func (c *Client) GetThermostat(thermostatID string) (*Thermostat, error) {
 	return &thermostats[0], nil
 }
 
-func (c *Client) GetThermostats(selection Selection) ([]Thermostat, error) {
+func (c *Client) GetThermostats(ctx context.Context, selection Selection) ([]Thermostat, error) {
 	req := GetThermostatsRequest{
 		Selection: selection,
 	}
@@ -109,9 +154,9 @@ func (c *Client) GetThermostats(selection Selection) ([]Thermostat, error) {
 		return nil, fmt.Errorf("error marshaling json: %v", err)
 	}
 
-	body, err := c.get(thermostatAPIURL, j)
+	body, err := c.get(ctx, c.endpoint(thermostatAPIURL), j)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching thermostats: %v", err)
+		return nil, fmt.Errorf("error fetching thermostats: %w", err)
 	}
 
 	var r GetThermostatsResponse
@@ -121,13 +166,13 @@ func (c *Client) GetThermostats(selection Selection) ([]Thermostat, error) {
 
 	glog.V(1).Infof("GetThermostats response: %#v", r)
 
-	if r.Status.Code != 0 {
-		return nil, fmt.Errorf("api error %d: %v", r.Status.Code, r.Status.Message)
+	if err := statusError(r.Status); err != nil {
+		return nil, err
 	}
 	return r.ThermostatList, nil
 }
 
-func (c *Client) GetThermostatSummary(selection Selection) (map[string]ThermostatSummary, error) {
+func (c *Client) GetThermostatSummary(ctx context.Context, selection Selection) (map[string]ThermostatSummary, error) {
 	req := GetThermostatSummaryRequest{
 		Selection: selection,
 	}
@@ -136,9 +181,9 @@ func (c *Client) GetThermostatSummary(selection Selection) (map[string]Thermosta
 		return nil, fmt.Errorf("error marshaling json: %v", err)
 	}
 
-	body, err := c.get(thermostatSummaryURL, j)
+	body, err := c.get(ctx, c.endpoint(thermostatSummaryURL), j)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching thermostat summary: %v", err)
+		return nil, fmt.Errorf("error fetching thermostat summary: %w", err)
 	}
 
 	var r GetThermostatSummaryResponse
@@ -148,18 +193,31 @@ func (c *Client) GetThermostatSummary(selection Selection) (map[string]Thermosta
 
 	glog.V(1).Infof("GetThermostatSummary response: %#v", r)
 
+	if err := statusError(r.Status); err != nil {
+		return nil, err
+	}
+
 	tsm := make(ThermostatSummaryMap, r.ThermostatCount)
 
-	for i := 0; i < r.ThermostatCount; i++ {
+	// Both lists start each entry with the thermostat ID, so statuses are
+	// matched to revisions by ID rather than by position.
+	statuses := make(map[string]string, len(r.StatusList))
+	for _, s := range r.StatusList {
+		statuses[strings.SplitN(s, ":", 2)[0]] = s
+	}
+
+	for i := 0; i < r.ThermostatCount && i < len(r.RevisionList); i++ {
 		rl := strings.Split(r.RevisionList[i], ":")
 		if len(rl) < 7 {
 			return nil, fmt.Errorf("invalid RevisionList, not enough fields: %s", r.RevisionList[i])
 		}
 
-		// Assume order of RevisionList and StatusList is the same.
-		es, err := buildEquipmentStatus(r.StatusList[i])
-		if err != nil {
-			return nil, fmt.Errorf("error in buildEquipmentSTatus(%v): %v", r.StatusList[i], err)
+		var es EquipmentStatus
+		if status, ok := statuses[rl[0]]; ok {
+			es, err = buildEquipmentStatus(status)
+			if err != nil {
+				return nil, fmt.Errorf("error in buildEquipmentSTatus(%v): %v", status, err)
+			}
 		}
 
 		connected, err := strconv.ParseBool(rl[2])
@@ -186,6 +244,7 @@ func (c *Client) GetThermostatSummary(selection Selection) (map[string]Thermosta
 // of `endDate` (UTC). The dates should be in format "YYYY-MM-DD".
 // `thermostatID` is a comma separated list of thermostat IDs to get data for.
 func (c *Client) GetRuntimeReport(
+	ctx context.Context,
 	thermostatID string,
 	startDate string,
 	endDate string,
@@ -196,8 +255,342 @@ func (c *Client) GetRuntimeReport(
 	WriteHeatPump2 bool,
 	WriteCool1 bool,
 	WriteCool2 bool,
+	ExtraColumns []string,
 ) (map[string]interface{}, error) {
-	s := Selection{
+	if err := checkDateRange(startDate, endDate); err != nil {
+		return nil, err
+	}
+
+	cols := runtimeReportColumns(
+		WriteHumidifier,
+		WriteAuxHeat1,
+		WriteAuxHeat2,
+		WriteHeatPump1,
+		WriteHeatPump2,
+		WriteCool1,
+		WriteCool2,
+		ExtraColumns)
+
+	// All thermostats share one column set, so one request covers as many
+	// thermostats as ecobee allows. Only larger lists need splitting.
+	ids := strings.Split(thermostatID, ",")
+
+	// Object to return to the caller.
+	report_data := map[string]interface{}{}
+
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxRuntimeReportThermostats {
+			n = maxRuntimeReportThermostats
+		}
+		data, err := c.runtimeReport(ctx, strings.Join(ids[:n], ","), startDate, endDate, cols)
+		if err != nil {
+			return nil, err
+		}
+		for id, entries := range data {
+			report_data[id] = entries
+		}
+		ids = ids[n:]
+	}
+
+	return report_data, nil
+}
+
+// runtimeReport makes a single runtime report request for up to
+// maxRuntimeReportThermostats thermostats.
+func (c *Client) runtimeReport(ctx context.Context, thermostatID, startDate, endDate, cols string) (map[string]interface{}, error) {
+	req := GetRuntimeReportRequest{
+		Selection:      runtimeReportSelection(thermostatID),
+		StartDate:      startDate,
+		EndDate:        endDate,
+		Columns:        cols,
+		IncludeSensors: true,
+	}
+	j, err := json.Marshal(&req)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling json: %v", err)
+	}
+
+	body, err := c.get(ctx, c.endpoint(runtimeReportURL), j)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching thermostat summary: %w", err)
+	}
+
+	var r RuntimeReportResponse
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("error unmarshalling json: %v", err)
+	}
+
+	glog.V(1).Infof("GetRuntimeReport response: %#v", r)
+
+	if err := statusError(r.Status); err != nil {
+		return nil, err
+	}
+
+	// Get the UTC time this report starts at.
+	utc_start_time, err := time.Parse("2006-01-02", r.StartDate)
+	if err != nil {
+		return nil, err
+	}
+	// Need to add the 5 minute interval to get the actual start time.
+	utc_start_time = utc_start_time.Add(time.Duration(r.StartInterval*5) * time.Minute)
+
+	// Row values are matched to columns by the header ecobee sends back, not
+	// by the order we asked for them in, so a reordered response is harmless.
+	received_columns := strings.Split(r.Columns, ",")
+	checkReceivedColumns(cols, received_columns, c.warn)
+
+	report_data := map[string]interface{}{}
+
+	if len(r.ReportList) == 0 {
+		c.warn("runtime report has no data", "thermostat_id", thermostatID, "start", startDate, "end", endDate)
+	}
+
+	locations := c.thermostatLocations(ctx, strings.Split(thermostatID, ","))
+
+	// Iterate each report in the response. This is per thermostat.
+	for _, report := range r.ReportList {
+		report_data[report.ThermostatIdentifier] = parseReportRows(report.RowList, received_columns,
+			utc_start_time, locations[report.ThermostatIdentifier], c.warn)
+	}
+
+	return report_data, nil
+}
+
+// GetRuntimeReportJob fetches the same data as GetRuntimeReport, but through
+// the asynchronous report job API. A job is submitted, polled until ecobee
+// finishes generating it, and then the resulting CSV files are downloaded and
+// decoded. This is slower for small ranges but holds up better for large
+// backfills that run into the synchronous endpoint's size limits.
+func (c *Client) GetRuntimeReportJob(
+	ctx context.Context,
+	thermostatID string,
+	startDate string,
+	endDate string,
+	WriteHumidifier bool,
+	WriteAuxHeat1 bool,
+	WriteAuxHeat2 bool,
+	WriteHeatPump1 bool,
+	WriteHeatPump2 bool,
+	WriteCool1 bool,
+	WriteCool2 bool,
+	ExtraColumns []string,
+) (map[string]interface{}, error) {
+	if err := checkDateRange(startDate, endDate); err != nil {
+		return nil, err
+	}
+
+	cols := runtimeReportColumns(
+		WriteHumidifier,
+		WriteAuxHeat1,
+		WriteAuxHeat2,
+		WriteHeatPump1,
+		WriteHeatPump2,
+		WriteCool1,
+		WriteCool2,
+		ExtraColumns)
+
+	// Report jobs always start at the first interval of `startDate`.
+	utc_start_time, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return nil, err
+	}
+
+	req := CreateRuntimeReportJobRequest{
+		Selection: runtimeReportSelection(thermostatID),
+		StartDate: startDate,
+		EndDate:   endDate,
+		Columns:   cols,
+		// Sensor data comes back as separate files we don't use.
+		IncludeSensors: false,
+	}
+	j, err := json.Marshal(&req)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling json: %v", err)
+	}
+
+	body, err := c.post(ctx, c.endpoint(runtimeReportJobCreateURL), j)
+	if err != nil {
+		return nil, fmt.Errorf("error creating report job: %w", err)
+	}
+
+	var cr CreateRuntimeReportJobResponse
+	if err = json.Unmarshal(body, &cr); err != nil {
+		return nil, fmt.Errorf("error unmarshalling json: %v", err)
+	}
+
+	glog.V(1).Infof("CreateRuntimeReportJob response: %#v", cr)
+
+	if err := statusError(cr.Status); err != nil {
+		return nil, err
+	}
+
+	job, err := c.waitForReportJob(ctx, cr.JobID)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := strings.Split(cols, ",")
+	rows := map[string][]string{}
+	for _, file := range job.Files {
+		data, err := c.downloadReportJobFile(ctx, file)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading report job %s: %v", job.JobID, err)
+		}
+		fileColumns, fileRows := parseReportJobCSV(data)
+		if fileColumns != nil {
+			columns = fileColumns
+		}
+		for id, r := range fileRows {
+			rows[id] = append(rows[id], r...)
+		}
+	}
+
+	locations := c.thermostatLocations(ctx, strings.Split(thermostatID, ","))
+
+	report_data := map[string]interface{}{}
+	for id, r := range rows {
+		// Files may be split arbitrarily; rows start with "YYYY-MM-DD,HH:MM:SS"
+		// so sorting puts them back in time order.
+		sort.Strings(r)
+		report_data[id] = parseReportRows(r, columns, utc_start_time, locations[id], c.warn)
+	}
+
+	return report_data, nil
+}
+
+// waitForReportJob polls the status of a report job until it completes, fails,
+// or takes longer than reportJobTimeout.
+func (c *Client) waitForReportJob(ctx context.Context, jobID string) (*ReportJob, error) {
+	req := GetRuntimeReportJobStatusRequest{
+		JobID: jobID,
+	}
+	j, err := json.Marshal(&req)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling json: %v", err)
+	}
+
+	deadline := time.Now().Add(reportJobTimeout)
+	for {
+		body, err := c.get(ctx, c.endpoint(runtimeReportJobStatusURL), j)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching report job status: %w", err)
+		}
+
+		var r GetRuntimeReportJobStatusResponse
+		if err = json.Unmarshal(body, &r); err != nil {
+			return nil, fmt.Errorf("error unmarshalling json: %v", err)
+		}
+
+		glog.V(1).Infof("GetRuntimeReportJobStatus response: %#v", r)
+
+		if err := statusError(r.Status); err != nil {
+			return nil, err
+		} else if len(r.Jobs) != 1 {
+			return nil, fmt.Errorf("got %d report jobs, wanted 1", len(r.Jobs))
+		}
+
+		job := r.Jobs[0]
+		switch job.Status {
+		case "completed":
+			return &job, nil
+		case "queued", "processing":
+			// Keep waiting.
+		default:
+			return nil, fmt.Errorf("report job %s %s: %s", jobID, job.Status, job.Message)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for report job %s", jobID)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(reportJobPollInterval):
+		}
+	}
+}
+
+// downloadReportJobFile fetches one of the files produced by a report job.
+// The file URLs are pre-signed, so this deliberately doesn't use the
+// authenticated client. Files may or may not be gzipped.
+func (c *Client) downloadReportJobFile(ctx context.Context, fileURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating get request: %v", err)
+	}
+	resp, err := c.files.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error on get request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %v", err)
+	}
+
+	if len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("error reading gzip: %v", err)
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	}
+	return body, nil
+}
+
+// parseReportJobCSV splits a report job CSV file into rows per thermostat.
+// Data lines look like "identifier,date,time,col1,col2,..."; the identifier is
+// stripped so the rows match the synchronous report's rowList format. If the
+// file has a header line its columns are returned, otherwise nil.
+func parseReportJobCSV(data []byte) ([]string, map[string][]string) {
+	var columns []string
+	rows := map[string][]string{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ",", 4)
+		if len(fields) < 3 {
+			continue
+		}
+		if strings.EqualFold(fields[1], "date") {
+			if len(fields) == 4 {
+				columns = strings.Split(fields[3], ",")
+			}
+			continue
+		}
+		rows[fields[0]] = append(rows[fields[0]], strings.Join(fields[1:], ","))
+	}
+	return columns, rows
+}
+
+// checkDateRange makes sure a report's dates are valid and in order.
+func checkDateRange(startDate, endDate string) error {
+	start, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return fmt.Errorf("invalid start date: %v", err)
+	}
+	end, err := time.Parse("2006-01-02", endDate)
+	if err != nil {
+		return fmt.Errorf("invalid end date: %v", err)
+	}
+	if end.Before(start) {
+		return fmt.Errorf("end date %s is before start date %s", endDate, startDate)
+	}
+	return nil
+}
+
+// runtimeReportSelection is the selection used for runtime report requests.
+func runtimeReportSelection(thermostatID string) Selection {
+	return Selection{
 		SelectionType:  "thermostats",
 		SelectionMatch: thermostatID,
 
@@ -210,8 +603,19 @@ func (c *Client) GetRuntimeReport(
 		IncludeSensors:         true,
 		IncludeWeather:         true,
 	}
+}
 
-	// Need to create a CSV of columns we want in the report
+// runtimeReportColumns creates the CSV of columns we want in the report.
+func runtimeReportColumns(
+	WriteHumidifier bool,
+	WriteAuxHeat1 bool,
+	WriteAuxHeat2 bool,
+	WriteHeatPump1 bool,
+	WriteHeatPump2 bool,
+	WriteCool1 bool,
+	WriteCool2 bool,
+	ExtraColumns []string,
+) string {
 	var col_to_include []string = []string{
 		"zoneCoolTemp",
 		"zoneHeatTemp",
@@ -237,114 +641,275 @@ func (c *Client) GetRuntimeReport(
 	if WriteHeatPump1 {
 		col_to_include = append(col_to_include, "compHeat1")
 	}
+	if WriteHeatPump2 {
+		col_to_include = append(col_to_include, "compHeat2")
+	}
 	if WriteCool1 {
 		col_to_include = append(col_to_include, "compCool1")
 	}
 	if WriteCool2 {
 		col_to_include = append(col_to_include, "compCool2")
 	}
-	cols := strings.Join(col_to_include[:], ",")
+	for _, extra := range ExtraColumns {
+		included := false
+		for _, col := range col_to_include {
+			if col == extra {
+				included = true
+				break
+			}
+		}
+		if !included {
+			col_to_include = append(col_to_include, extra)
+		}
+	}
+	return strings.Join(col_to_include[:], ",")
+}
 
-	req := GetRuntimeReportRequest{
-		Selection:      s,
-		StartDate:      startDate,
-		EndDate:        endDate,
-		Columns:        cols,
-		IncludeSensors: true,
+// checkReceivedColumns logs any requested columns missing from a response,
+// since their fields will silently be absent.
+func checkReceivedColumns(requested string, received []string, warn Logger) {
+	got := map[string]bool{}
+	for _, col := range received {
+		got[col] = true
 	}
-	j, err := json.Marshal(&req)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling json: %v", err)
+	for _, col := range strings.Split(requested, ",") {
+		if !got[col] {
+			warn("runtime report did not include requested column", "column", col)
+		}
 	}
+}
 
-	body, err := c.get(runtimeReportURL, j)
-	if err != nil {
-		return nil, fmt.Errorf("error fetching thermostat summary: %v", err)
+// thermostatLocations returns the time zone of each of the given thermostats
+// that ecobee knows it for. Time zones are fetched once and then cached. If
+// they can't be fetched, the thermostats are left out and their report rows
+// fall back to an offset inferred from the report's start time.
+func (c *Client) thermostatLocations(ctx context.Context, ids []string) map[string]*time.Location {
+	c.locationsMu.Lock()
+	defer c.locationsMu.Unlock()
+	if c.locations == nil {
+		c.locations = map[string]*time.Location{}
 	}
 
-	var r RuntimeReportResponse
-	if err = json.Unmarshal(body, &r); err != nil {
-		return nil, fmt.Errorf("error unmarshalling json: %v", err)
+	var missing []string
+	for _, id := range ids {
+		if _, ok := c.locations[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		thermostats, err := c.GetThermostats(ctx, Selection{
+			SelectionType:   "thermostats",
+			SelectionMatch:  strings.Join(missing, ","),
+			IncludeLocation: true,
+		})
+		if err != nil {
+			c.warn("unable to fetch thermostat time zones", "error", err)
+		}
+		for _, t := range thermostats {
+			loc, err := time.LoadLocation(t.Location.TimeZone)
+			if err != nil || t.Location.TimeZone == "" {
+				c.warn("unknown thermostat time zone", "thermostat_id", t.Identifier, "time_zone", t.Location.TimeZone)
+				loc = nil
+			}
+			c.locations[t.Identifier] = loc
+		}
 	}
 
-	glog.V(1).Infof("GetThermostatSummary response: %#v", r)
+	locations := map[string]*time.Location{}
+	for _, id := range ids {
+		if loc := c.locations[id]; loc != nil {
+			locations[id] = loc
+		}
+	}
+	return locations
+}
 
-	// Get the UTC time this report starts at.
-	utc_start_time, err := time.Parse("2006-01-02", r.StartDate)
-	if err != nil {
-		return nil, err
+// parseReportRows converts the CSV rows for a single thermostat into data
+// entries with UTC timestamps. Rows are in the thermostat's local time, so
+// they are parsed in loc if it is known. Otherwise the offset from UTC is
+// inferred from the first row, which is wrong for rows after a DST change.
+//
+// When DST ends, the repeated hour's rows have the same local times as the
+// hour before, so a row's position is used to tell which of the two it is.
+func parseReportRows(rows []string, received_columns []string, utc_start_time time.Time, loc *time.Location, warn Logger) []RuntimeReportDataEntry {
+	// Split the rows, skipping any that are too short to hold every column
+	// or don't start with a valid date and time, so a truncated response
+	// can't take the connector down.
+	type parsedRow struct {
+		// Position in rows, since each row is 5 minutes after the one before.
+		index          int
+		fields         []string
+		thermostatTime time.Time
+	}
+	parsed := []parsedRow{}
+	for i, entry := range rows {
+		fields := strings.Split(entry, ",")
+		if len(fields) < 2+len(received_columns) {
+			warn("skipping runtime report row with too few fields", "fields", len(fields), "want", 2+len(received_columns), "row", entry)
+			continue
+		}
+		// First is date, second is time.
+		thermostat_time, err := time.Parse("2006-01-02 15:04:05", fmt.Sprintf("%s %s", fields[0], fields[1]))
+		if err != nil {
+			warn("skipping runtime report row with invalid time", "row", entry)
+			continue
+		}
+		parsed = append(parsed, parsedRow{i, fields, thermostat_time})
 	}
-	// Need to add the 5 minute interval to get the actual start time.
-	utc_start_time = utc_start_time.Add(time.Duration(r.StartInterval*5) * time.Minute)
 
-	received_columns := strings.Split(r.Columns, ",")
+	// No data for this thermostat in the requested range.
+	if len(parsed) == 0 {
+		return []RuntimeReportDataEntry{}
+	}
 
-	// Object to return to the caller.
-	report_data := map[string]interface{}{}
+	// Use the first row to calculate the time offset between the thermostat
+	// time and UTC. We assume the first entry matches the start time.
+	first := parsed[0]
+	time_offset := utc_start_time.Add(time.Duration(first.index*5) * time.Minute).Sub(first.thermostatTime)
 
-	// Iterate each report in the response. This is per thermostat.
-	for _, report := range r.ReportList {
+	// Each row is 5 minutes after the one before, counting from the first.
+	var first_utc time.Time
+	if loc != nil {
+		first_utc = localReportTime(first.thermostatTime, loc, time.Time{})
+	}
 
-		// Get the first row to calculate the time offset between the thermostat
-		// time and UTC. We assume the first entry matches the start time.
-		fields := strings.Split(report.RowList[0], ",")
-		d := fields[0]
-		t := fields[1]
-		entry_thermostat_time, _ := time.Parse("2006-01-02 15:04:05", fmt.Sprintf("%s %s", d, t))
-		time_offset := utc_start_time.Sub(entry_thermostat_time)
-
-		// List of measurements in an interval.
-		data := []RuntimeReportDataEntry{}
-
-		// Now we can iterate all of the data rows.
-		for _, entry := range report.RowList {
-			// fmt.Printf("%s\n", entry)
-			fields := strings.Split(entry, ",")
-			// First is date.
-			d := fields[0]
-			// Second is time.
-			t := fields[1]
-
-			// Get the interval time in UTC.
-			entry_time, _ := time.Parse("2006-01-02 15:04:05", fmt.Sprintf("%s %s", d, t))
-			entry_time = entry_time.Add(time_offset)
-
-			// fmt.Printf("%s %s (%s) (%v):\n", d, t, fmt.Sprintf("%s %s", d, t), entry_time)
-
-			// Collect all of the measurements.
-			formatted_entry := map[string]string{}
-			for i, col := range received_columns {
-				// If empty, skip over.
-				if len(fields[i+2]) > 0 {
-					formatted_entry[col] = fields[i+2]
-				}
-			}
+	// List of measurements in an interval.
+	data := []RuntimeReportDataEntry{}
+
+	// Now we can iterate all of the data rows.
+	for _, row := range parsed {
+		fields := row.fields
 
-			tmp := RuntimeReportDataEntry{
-				ReportTime: entry_time,
-				DataFields: formatted_entry,
+		// Get the interval time in UTC.
+		entry_time := row.thermostatTime.Add(time_offset)
+		if loc != nil {
+			expected := first_utc.Add(time.Duration((row.index-first.index)*5) * time.Minute)
+			entry_time = localReportTime(row.thermostatTime, loc, expected)
+		}
+
+		// Collect all of the measurements.
+		formatted_entry := map[string]string{}
+		for i, col := range received_columns {
+			// If empty, skip over.
+			if len(fields[i+2]) > 0 {
+				formatted_entry[col] = fields[i+2]
 			}
+		}
 
-			data = append(data, tmp)
+		tmp := RuntimeReportDataEntry{
+			ReportTime:     entry_time,
+			ThermostatTime: row.thermostatTime,
+			DataFields:     formatted_entry,
 		}
 
-		report_data[report.ThermostatIdentifier] = data
+		data = append(data, tmp)
 	}
 
-	return report_data, nil
+	return data
+}
+
+// localReportTime returns the UTC time that the local time wall (parsed as if
+// it were UTC) names in loc. A local time in the hour repeated when DST ends
+// names two times, and one in the hour skipped when DST starts names none;
+// those resolve to whichever is closest to expected, or expected itself. If
+// expected is zero, the earlier of two times is used.
+func localReportTime(wall time.Time, loc *time.Location, expected time.Time) time.Time {
+	local := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, loc)
+
+	// DST changes are months apart, so the offsets half a day either side
+	// are the only ones that can apply.
+	const layout = "2006-01-02 15:04:05"
+	var candidates []time.Time
+	for _, probe := range []time.Time{local.Add(-12 * time.Hour), local.Add(12 * time.Hour)} {
+		_, offset := probe.Zone()
+		t := wall.Add(-time.Duration(offset) * time.Second)
+		if t.In(loc).Format(layout) != wall.Format(layout) {
+			continue
+		}
+		if len(candidates) == 0 || !candidates[0].Equal(t) {
+			candidates = append(candidates, t)
+		}
+	}
+
+	if len(candidates) == 0 {
+		if expected.IsZero() {
+			return local.UTC()
+		}
+		return expected.UTC()
+	}
+	// Candidates are in offset order, which for a repeated hour is time
+	// order.
+	best := candidates[0]
+	if !expected.IsZero() {
+		for _, t := range candidates {
+			if absDuration(t.Sub(expected)) < absDuration(best.Sub(expected)) {
+				best = t
+			}
+		}
+	}
+	return best.UTC()
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
 }
 
-func (c *Client) get(endpoint string, rawRequest []byte) ([]byte, error) {
+func (c *Client) get(ctx context.Context, endpoint string, rawRequest []byte) ([]byte, error) {
 	glog.V(2).Infof("get(%s?json=%s)", endpoint, rawRequest)
 	request := url.QueryEscape(string(rawRequest))
-	resp, err := c.Get(fmt.Sprintf("%s?json=%s", endpoint, request))
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s?json=%s", endpoint, request), nil)
 	if err != nil {
-		return nil, fmt.Errorf("error on get request: %v", err)
+		return nil, fmt.Errorf("error creating get request: %v", err)
+	}
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error on get request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err := responseError(resp)
+		c.recordRateLimit(err)
+		return nil, err
+	}
+	c.recordRateLimit(nil)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %v", err)
+	}
+
+	glog.V(2).Infof("responses: %s", body)
+
+	return body, nil
+}
+
+func (c *Client) post(ctx context.Context, endpoint string, rawRequest []byte) ([]byte, error) {
+	glog.V(2).Infof("post(%s, %s)", endpoint, rawRequest)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(rawRequest))
+	if err != nil {
+		return nil, fmt.Errorf("error creating post request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := c.waitForRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error on post request: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("invalid server response: %v", resp.Status)
+		err := responseError(resp)
+		c.recordRateLimit(err)
+		return nil, err
 	}
+	c.recordRateLimit(nil)
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -362,7 +927,7 @@ func buildEquipmentStatus(input string) (EquipmentStatus, error) {
 	split := strings.SplitN(input, ":", 2)
 
 	// Nothing on the right hand side.
-	if len(split[1]) == 0 {
+	if len(split) < 2 || len(split[1]) == 0 {
 		return es, nil
 	}
 
@@ -382,6 +947,58 @@ func buildEquipmentStatus(input string) (EquipmentStatus, error) {
 	return es, nil
 }
 
+// Bit assignments for EquipmentStatus.Bitmask.
+const (
+	HeatPumpBit = 1 << iota
+	HeatPump2Bit
+	HeatPump3Bit
+	CompCool1Bit
+	CompCool2Bit
+	AuxHeat1Bit
+	AuxHeat2Bit
+	AuxHeat3Bit
+	FanBit
+	HumidifierBit
+	DehumidifierBit
+	VentilatorBit
+	EconomizerBit
+	CompHotWaterBit
+	AuxHotWaterBit
+)
+
+// Bitmask encodes the equipment status as a single integer using the *Bit
+// constants, one bit per piece of equipment that is running.
+func (es *EquipmentStatus) Bitmask() int {
+	bits := []struct {
+		on  bool
+		bit int
+	}{
+		{es.HeatPump, HeatPumpBit},
+		{es.HeatPump2, HeatPump2Bit},
+		{es.HeatPump3, HeatPump3Bit},
+		{es.CompCool1, CompCool1Bit},
+		{es.CompCool2, CompCool2Bit},
+		{es.AuxHeat1, AuxHeat1Bit},
+		{es.AuxHeat2, AuxHeat2Bit},
+		{es.AuxHeat3, AuxHeat3Bit},
+		{es.Fan, FanBit},
+		{es.Humidifier, HumidifierBit},
+		{es.Dehumidifier, DehumidifierBit},
+		{es.Ventilator, VentilatorBit},
+		{es.Economizer, EconomizerBit},
+		{es.CompHotWater, CompHotWaterBit},
+		{es.AuxHotWater, AuxHotWaterBit},
+	}
+
+	mask := 0
+	for _, b := range bits {
+		if b.on {
+			mask |= b.bit
+		}
+	}
+	return mask
+}
+
 func (es *EquipmentStatus) Set(field string, state bool) {
 	switch field {
 	case "heatPump":
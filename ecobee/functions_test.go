@@ -0,0 +1,353 @@
+package ecobee
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// localRows returns a runtime report row for every 5 minutes from start to
+// end, with the local time in loc and the row's position as its only column.
+// It also returns each row's UTC time.
+func localRows(start, end time.Time, loc *time.Location) ([]string, []time.Time) {
+	rows := []string{}
+	times := []time.Time{}
+	for t := start; !t.After(end); t = t.Add(5 * time.Minute) {
+		rows = append(rows, fmt.Sprintf("%s,%d", t.In(loc).Format("2006-01-02,15:04:05"), len(rows)))
+		times = append(times, t)
+	}
+	return rows, times
+}
+
+func TestParseReportRowsDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		name       string
+		start, end string
+	}{
+		// 2:00 to 2:55 local is skipped.
+		{"spring forward", "2020-03-08T05:00:00Z", "2020-03-08T08:00:00Z"},
+		// 1:00 to 1:55 local happens twice.
+		{"fall back", "2020-11-01T04:00:00Z", "2020-11-01T07:00:00Z"},
+	}
+	for _, tt := range tests {
+		start, _ := time.Parse(time.RFC3339, tt.start)
+		end, _ := time.Parse(time.RFC3339, tt.end)
+		rows, want := localRows(start, end, loc)
+		reportDate, _ := time.Parse("2006-01-02", start.In(loc).Format("2006-01-02"))
+
+		data := parseReportRows(rows, []string{"value"}, reportDate, loc, t.Logf)
+		if len(data) != len(want) {
+			t.Fatalf("%s: got %d entries, want %d", tt.name, len(data), len(want))
+		}
+		for i := range want {
+			if !data[i].ReportTime.Equal(want[i]) {
+				t.Errorf("%s: row %d (%s) at %s, want %s", tt.name, i, rows[i], data[i].ReportTime.Format(time.RFC3339), want[i].Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+func TestLocalReportTime(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	wall, _ := time.Parse("2006-01-02 15:04:05", "2020-11-01 01:30:00")
+	first := time.Date(2020, 11, 1, 5, 30, 0, 0, time.UTC)
+	second := time.Date(2020, 11, 1, 6, 30, 0, 0, time.UTC)
+	if got := localReportTime(wall, loc, time.Time{}); !got.Equal(first) {
+		t.Errorf("no expected time: got %s, want %s", got, first)
+	}
+	if got := localReportTime(wall, loc, second.Add(-5*time.Minute)); !got.Equal(second) {
+		t.Errorf("expected near second: got %s, want %s", got, second)
+	}
+}
+
+// warnings records what is logged to it.
+type warnings []string
+
+func (w *warnings) log(msg string, keyvals ...interface{}) {
+	*w = append(*w, fmt.Sprint(append([]interface{}{msg}, keyvals...)...))
+}
+
+func TestParseReportRowsRagged(t *testing.T) {
+	rows := []string{
+		"2020-01-01,00:00:00,1,2",
+		"2020-01-01,00:05:00,3",
+		"2020-01-01,00:10:00,,",
+		"2020-01-01,bad,5,6",
+		"2020-01-01,00:20:00,7,8,9",
+	}
+	start, _ := time.Parse("2006-01-02", "2020-01-01")
+	var w warnings
+	data := parseReportRows(rows, []string{"a", "b"}, start, nil, w.log)
+
+	if len(w) != 2 {
+		t.Errorf("logged %q, want 2 warnings", w)
+	}
+	want := []map[string]string{{"a": "1", "b": "2"}, {}, {"a": "7", "b": "8"}}
+	if len(data) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(data), len(want))
+	}
+	for i := range want {
+		if fmt.Sprint(data[i].DataFields) != fmt.Sprint(want[i]) {
+			t.Errorf("entry %d has %v, want %v", i, data[i].DataFields, want[i])
+		}
+	}
+	if got, want := data[2].ReportTime.Format("15:04"), "00:20"; got != want {
+		t.Errorf("last entry at %s, want %s", got, want)
+	}
+}
+
+func TestThermostatLocationsUnknownZone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"thermostatList": [{"identifier": "123", "location": {"timeZone": "Nowhere/Special"}}], "status": {"code": 0}}`)
+	}))
+	defer server.Close()
+
+	var w warnings
+	c := newClient(server.Client(), []ClientOption{WithBaseURL(server.URL), WithLogger(w.log)})
+	locs := c.thermostatLocations(context.Background(), []string{"123"})
+	if loc, ok := locs["123"]; ok {
+		t.Errorf("location = %v, want none for an unknown time zone", loc)
+	}
+	if len(w) != 1 || !strings.Contains(w[0], "Nowhere/Special") {
+		t.Errorf("logged %q, want a warning about Nowhere/Special", w)
+	}
+}
+
+func TestGetRuntimeReportReorderedColumns(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/runtimeReport":
+			// Columns in a different order than requested, without zoneClimate.
+			fmt.Fprint(w, `{
+				"startDate": "2020-01-01", "startInterval": 0,
+				"columns": "zoneAveTemp,zoneHeatTemp,zoneCoolTemp,zoneHumidity,outdoorTemp,outdoorHumidity,fan,hvacMode,sky,wind",
+				"reportList": [{"thermostatIdentifier": "123", "rowList": ["2020-01-01,00:00:00,70.5,68,75,40,30.1,50,300,heat,5,10"]}],
+				"status": {"code": 0}
+			}`)
+		default:
+			fmt.Fprint(w, `{"thermostatList": [], "status": {"code": 0}}`)
+		}
+	}))
+	defer server.Close()
+
+	var w warnings
+	c := newClient(server.Client(), []ClientOption{WithBaseURL(server.URL), WithLogger(w.log)})
+	report, err := c.GetRuntimeReport(context.Background(), "123", "2020-01-01", "2020-01-01",
+		false, false, false, false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, ok := report["123"].([]RuntimeReportDataEntry)
+	if !ok || len(entries) != 1 {
+		t.Fatalf("report = %#v, want one entry for 123", report)
+	}
+	want := map[string]string{
+		"zoneAveTemp":     "70.5",
+		"zoneHeatTemp":    "68",
+		"zoneCoolTemp":    "75",
+		"zoneHumidity":    "40",
+		"outdoorTemp":     "30.1",
+		"outdoorHumidity": "50",
+		"fan":             "300",
+		"hvacMode":        "heat",
+		"sky":             "5",
+		"wind":            "10",
+	}
+	if got := entries[0].DataFields; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("fields = %v, want %v", got, want)
+	}
+	if len(w) != 1 || !strings.Contains(w[0], "zoneClimate") {
+		t.Errorf("logged %q, want one warning about zoneClimate", w)
+	}
+}
+
+func TestGetRuntimeReportEmpty(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"startDate": "2020-01-01", "columns": "zoneCoolTemp", "reportList": [], "thermostatList": [], "status": {"code": 0}}`)
+	}))
+	defer server.Close()
+
+	var w warnings
+	c := newClient(server.Client(), []ClientOption{WithBaseURL(server.URL), WithLogger(w.log)})
+	report, err := c.GetRuntimeReport(context.Background(), "123", "2020-01-01", "2020-01-01",
+		false, false, false, false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 0 {
+		t.Errorf("report = %v, want no thermostats", report)
+	}
+	found := false
+	for _, msg := range w {
+		if strings.Contains(msg, "no data") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("logged %q, want a warning that the report has no data", w)
+	}
+}
+
+func TestGetRuntimeReportTwoThermostats(t *testing.T) {
+	var requests []GetRuntimeReportRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/runtimeReport" {
+			fmt.Fprint(w, `{"thermostatList": [], "status": {"code": 0}}`)
+			return
+		}
+		var req GetRuntimeReportRequest
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("json")), &req); err != nil {
+			t.Errorf("bad request %q: %v", r.URL.RawQuery, err)
+		}
+		requests = append(requests, req)
+		fmt.Fprint(w, `{
+			"startDate": "2020-01-01", "startInterval": 0,
+			"columns": "zoneAveTemp",
+			"reportList": [
+				{"thermostatIdentifier": "123", "rowList": ["2020-01-01,00:00:00,70.5", "2020-01-01,00:05:00,70.6"]},
+				{"thermostatIdentifier": "456", "rowList": ["2020-01-01,00:00:00,65"]}
+			],
+			"status": {"code": 0}
+		}`)
+	}))
+	defer server.Close()
+
+	c := newClient(server.Client(), []ClientOption{WithBaseURL(server.URL), WithLogger(t.Logf)})
+	report, err := c.GetRuntimeReport(context.Background(), "123,456", "2020-01-01", "2020-01-01",
+		false, false, false, false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 {
+		t.Fatalf("made %d runtime report requests, want 1", len(requests))
+	}
+	if got := requests[0].Selection.SelectionMatch; got != "123,456" {
+		t.Errorf("selectionMatch = %q, want both thermostats", got)
+	}
+	want := map[string][]string{"123": {"70.5", "70.6"}, "456": {"65"}}
+	for id, temps := range want {
+		entries, _ := report[id].([]RuntimeReportDataEntry)
+		if len(entries) != len(temps) {
+			t.Errorf("thermostat %s has %d entries, want %d", id, len(entries), len(temps))
+			continue
+		}
+		for i, temp := range temps {
+			if got := entries[i].DataFields["zoneAveTemp"]; got != temp {
+				t.Errorf("thermostat %s entry %d zoneAveTemp = %q, want %q", id, i, got, temp)
+			}
+		}
+	}
+}
+
+func TestEquipmentStatusBitmask(t *testing.T) {
+	es, err := buildEquipmentStatus("123:heatPump,auxHeat1,fan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := es.Bitmask(), HeatPumpBit|AuxHeat1Bit|FanBit; got != want {
+		t.Errorf("Bitmask() = %b, want %b", got, want)
+	}
+	if got, want := es.Bitmask(), 0x121; got != want {
+		t.Errorf("Bitmask() = %#x, want %#x", got, want)
+	}
+
+	es, err = buildEquipmentStatus("123:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := es.Bitmask(); got != 0 {
+		t.Errorf("Bitmask() with nothing running = %b, want 0", got)
+	}
+}
+
+func TestEquipmentStatusBitmaskDecode(t *testing.T) {
+	// Each piece of equipment sets exactly one bit, and no two share one.
+	names := []string{
+		"heatPump", "heatPump2", "heatPump3", "compCool1", "compCool2",
+		"auxHeat1", "auxHeat2", "auxHeat3", "fan", "humidifier",
+		"dehumidifier", "ventilator", "economizer", "compHotWater", "auxHotWater",
+	}
+	seen := 0
+	for i, name := range names {
+		var es EquipmentStatus
+		es.Set(name, true)
+		mask := es.Bitmask()
+		if mask != 1<<uint(i) {
+			t.Errorf("%s: Bitmask() = %b, want bit %d", name, mask, i)
+		}
+		if seen&mask != 0 {
+			t.Errorf("%s: bit %b already used", name, mask)
+		}
+		seen |= mask
+	}
+}
+
+func TestGetRuntimeReportDates(t *testing.T) {
+	var req GetRuntimeReportRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/runtimeReport" {
+			if err := json.Unmarshal([]byte(r.URL.Query().Get("json")), &req); err != nil {
+				t.Errorf("bad request %q: %v", r.URL.RawQuery, err)
+			}
+		}
+		fmt.Fprint(w, `{"startDate": "2023-03-04", "columns": "zoneAveTemp", "reportList": [], "thermostatList": [], "status": {"code": 0}}`)
+	}))
+	defer server.Close()
+
+	c := newClient(server.Client(), []ClientOption{WithBaseURL(server.URL), WithLogger(t.Logf)})
+	if _, err := c.GetRuntimeReport(context.Background(), "123", "2023-03-04", "2023-03-06",
+		false, false, false, false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if req.StartDate != "2023-03-04" || req.EndDate != "2023-03-06" {
+		t.Errorf("requested %s to %s, want 2023-03-04 to 2023-03-06", req.StartDate, req.EndDate)
+	}
+
+	req = GetRuntimeReportRequest{}
+	if _, err := c.GetRuntimeReport(context.Background(), "123", "2023-03-06", "2023-03-04",
+		false, false, false, false, false, false, false, nil); err == nil {
+		t.Error("GetRuntimeReport succeeded with the end before the start")
+	}
+	if req.StartDate != "" {
+		t.Errorf("sent a request for %s to %s with the end before the start", req.StartDate, req.EndDate)
+	}
+}
+
+func TestRuntimeReportColumnsFlags(t *testing.T) {
+	base := strings.Split(runtimeReportColumns(false, false, false, false, false, false, false, nil), ",")
+	inBase := map[string]bool{}
+	for _, col := range base {
+		inBase[col] = true
+	}
+
+	want := []string{"humidifier", "auxHeat1", "auxHeat2", "compHeat1", "compHeat2", "compCool1", "compCool2"}
+	for i, col := range want {
+		flags := make([]bool, len(want))
+		flags[i] = true
+		got := strings.Split(runtimeReportColumns(flags[0], flags[1], flags[2], flags[3], flags[4], flags[5], flags[6], nil), ",")
+
+		added := []string{}
+		for _, c := range got {
+			if !inBase[c] {
+				added = append(added, c)
+			}
+		}
+		if len(got) != len(base)+1 || len(added) != 1 || added[0] != col {
+			t.Errorf("flag %d added %q, want just %s", i, added, col)
+		}
+	}
+}
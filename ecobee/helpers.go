@@ -18,11 +18,16 @@ package ecobee
 // useful helpers.
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func (c *Client) ResumeProgram(id string, resumeAll bool) error {
+// ResumeProgram clears the latest hold on the thermostat, or every hold if
+// resumeAll is set, so it goes back to following its program.
+func (c *Client) ResumeProgram(ctx context.Context, id string, resumeAll bool) error {
 	r := &UpdateThermostatRequest{
 		Selection: Selection{
 			SelectionType:  "thermostats",
@@ -37,10 +42,10 @@ func (c *Client) ResumeProgram(id string, resumeAll bool) error {
 			},
 		},
 	}
-	return c.UpdateThermostat(*r)
+	return c.UpdateThermostat(ctx, *r)
 }
 
-func (c *Client) RunFan(id string, duration time.Duration) error {
+func (c *Client) RunFan(ctx context.Context, id string, duration time.Duration) error {
 	end := time.Now().Add(duration)
 	shp := SetHoldParams{
 		// these HoldTemps don't get used because the IsTemperature
@@ -70,10 +75,10 @@ func (c *Client) RunFan(id string, duration time.Duration) error {
 		},
 	}
 
-	return c.UpdateThermostat(*r)
+	return c.UpdateThermostat(ctx, *r)
 }
 
-func (c *Client) SendMessage(thermostat, message string) error {
+func (c *Client) SendMessage(ctx context.Context, thermostat, message string) error {
 	smp := SendMessageParams{
 		Alert: Alert{
 			AlertType:       "message",
@@ -95,7 +100,90 @@ func (c *Client) SendMessage(thermostat, message string) error {
 		},
 	}
 
-	return c.UpdateThermostat(*r)
+	return c.UpdateThermostat(ctx, *r)
+}
+
+// NormalizeRuntimeReportColumns matches user supplied column names against
+// RuntimeReportColumns ignoring case, and returns them with the case ecobee
+// expects. An unknown column would silently come back empty, so any names
+// that don't match are returned as an error.
+func NormalizeRuntimeReportColumns(columns []string) ([]string, error) {
+	known := map[string]string{}
+	for _, col := range RuntimeReportColumns {
+		known[strings.ToLower(col)] = col
+	}
+
+	normalized := []string{}
+	unknown := []string{}
+	for _, col := range columns {
+		if canonical, ok := known[strings.ToLower(strings.TrimSpace(col))]; ok {
+			normalized = append(normalized, canonical)
+		} else {
+			unknown = append(unknown, col)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown runtime report columns: %s", strings.Join(unknown, ", "))
+	}
+	return normalized, nil
+}
+
+// ClimateAt returns the name of the climate (comfort setting) the program
+// schedules for the given thermostat-local time. The schedule has one row per
+// day starting on Monday, each with 48 half hour slots holding a climateRef.
+func (p *Program) ClimateAt(t time.Time) (string, bool) {
+	day := (int(t.Weekday()) + 6) % 7
+	slot := t.Hour()*2 + t.Minute()/30
+	if day >= len(p.Schedule) || slot >= len(p.Schedule[day]) {
+		return "", false
+	}
+
+	ref := p.Schedule[day][slot]
+	for _, c := range p.Climates {
+		if c.ClimateRef == ref {
+			return c.Name, true
+		}
+	}
+	return "", false
+}
+
+// CurrentClimate returns the climate the thermostat is currently running.
+func (p *Program) CurrentClimate() (Climate, bool) {
+	for _, c := range p.Climates {
+		if c.ClimateRef == p.CurrentClimateRef {
+			return c, true
+		}
+	}
+	return Climate{}, false
+}
+
+// RuntimeEquipmentStatus builds the equipment status for a runtime report
+// interval. A piece of equipment counts as running if it ran for any part of
+// the interval.
+func RuntimeEquipmentStatus(dataFields map[string]string) EquipmentStatus {
+	// Runtime report columns and the matching equipment status names.
+	columns := map[string]string{
+		"compHeat1":    "heatPump",
+		"compHeat2":    "heatPump2",
+		"compCool1":    "compCool1",
+		"compCool2":    "compCool2",
+		"auxHeat1":     "auxHeat1",
+		"auxHeat2":     "auxHeat2",
+		"auxHeat3":     "auxHeat3",
+		"fan":          "fan",
+		"humidifier":   "humidifier",
+		"dehumidifier": "dehumidifier",
+		"ventilator":   "ventilator",
+		"economizer":   "economizer",
+	}
+
+	var es EquipmentStatus
+	for col, status := range columns {
+		if seconds, err := strconv.Atoi(dataFields[col]); err == nil && seconds > 0 {
+			es.Set(status, true)
+		}
+	}
+	return es
 }
 
 // The Ecobee API represents temperatures as integers.
@@ -130,7 +218,45 @@ func tempCheck(heat, cool float64) error {
 	return nil
 }
 
-func (c *Client) HoldTemp(thermostat string, heat, cool float64, d time.Duration) error {
+// SetHold holds the thermostat at the given setpoints (in °F). holdType is
+// "indefinite" or "nextTransition"; use HoldTemp to hold for a duration.
+func (c *Client) SetHold(ctx context.Context, thermostatID string, coolF, heatF float64, holdType string) error {
+	if holdType != "indefinite" && holdType != "nextTransition" {
+		return fmt.Errorf("invalid hold type %q", holdType)
+	}
+	if err := tempCheck(heatF, coolF); err != nil {
+		return err
+	}
+
+	ht, cl := makeTemp(heatF, coolF)
+
+	shp := SetHoldParams{
+		HeatHoldTemp: ht,
+		CoolHoldTemp: cl,
+		HoldType:     holdType,
+		Event: Event{
+			Fan:                   "auto",
+			IsTemperatureAbsolute: true,
+		},
+	}
+
+	r := &UpdateThermostatRequest{
+		Selection: Selection{
+			SelectionType:  "thermostats",
+			SelectionMatch: thermostatID,
+		},
+		Functions: []Function{
+			{
+				Type:   "setHold",
+				Params: shp,
+			},
+		},
+	}
+
+	return c.UpdateThermostat(ctx, *r)
+}
+
+func (c *Client) HoldTemp(ctx context.Context, thermostat string, heat, cool float64, d time.Duration) error {
 	end := time.Now().Add(d)
 
 	if err := tempCheck(heat, cool); err != nil {
@@ -168,5 +294,5 @@ func (c *Client) HoldTemp(thermostat string, heat, cool float64, d time.Duration
 		},
 	}
 
-	return c.UpdateThermostat(*r)
+	return c.UpdateThermostat(ctx, *r)
 }
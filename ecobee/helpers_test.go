@@ -0,0 +1,135 @@
+package ecobee
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProgram returns a program that is "sleep" until 7:00 and "home" after
+// on weekdays, and "away" all weekend.
+func testProgram() *Program {
+	p := &Program{
+		Climates: []Climate{
+			{Name: "Home", ClimateRef: "home"},
+			{Name: "Away", ClimateRef: "away"},
+			{Name: "Sleep", ClimateRef: "sleep"},
+		},
+	}
+	for day := 0; day < 7; day++ {
+		row := make([]string, 48)
+		for slot := range row {
+			switch {
+			case day >= 5:
+				row[slot] = "away"
+			case slot < 14:
+				row[slot] = "sleep"
+			default:
+				row[slot] = "home"
+			}
+		}
+		p.Schedule = append(p.Schedule, row)
+	}
+	return p
+}
+
+func TestClimateAt(t *testing.T) {
+	tests := []struct {
+		time   string
+		want   string
+		wantOK bool
+	}{
+		// 2023-01-02 is a Monday.
+		{"2023-01-02 00:00", "Sleep", true},
+		{"2023-01-02 06:59", "Sleep", true},
+		{"2023-01-02 07:00", "Home", true},
+		{"2023-01-06 23:59", "Home", true},
+		{"2023-01-07 07:00", "Away", true},
+		{"2023-01-08 23:59", "Away", true},
+	}
+	p := testProgram()
+	for _, tt := range tests {
+		tm, err := time.Parse("2006-01-02 15:04", tt.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := p.ClimateAt(tm)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("ClimateAt(%s) = %q, %v, want %q, %v", tt.time, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestClimateAtUnknown(t *testing.T) {
+	monday := time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	p := testProgram()
+	p.Schedule[0][24] = "vacation"
+	if got, ok := p.ClimateAt(monday); ok {
+		t.Errorf("ClimateAt with an unknown climateRef = %q, want not found", got)
+	}
+
+	p = testProgram()
+	p.Schedule = p.Schedule[:0]
+	if got, ok := p.ClimateAt(monday); ok {
+		t.Errorf("ClimateAt with no schedule = %q, want not found", got)
+	}
+}
+
+func TestResumeProgram(t *testing.T) {
+	for _, resumeAll := range []bool{true, false} {
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.Path != "/thermostat" {
+				t.Errorf("got %s %s, want POST /thermostat", r.Method, r.URL.Path)
+			}
+			body, _ = ioutil.ReadAll(r.Body)
+			fmt.Fprint(w, `{"status": {"code": 0}}`)
+		}))
+
+		c := newClient(server.Client(), []ClientOption{WithBaseURL(server.URL), WithLogger(t.Logf)})
+		if err := c.ResumeProgram(context.Background(), "123", resumeAll); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+
+		var req struct {
+			Selection Selection `json:"selection"`
+			Functions []struct {
+				Type   string                     `json:"type"`
+				Params map[string]json.RawMessage `json:"params"`
+			} `json:"functions"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatalf("bad request body %q: %v", body, err)
+		}
+		if req.Selection.SelectionType != "thermostats" || req.Selection.SelectionMatch != "123" {
+			t.Errorf("selection = %+v, want thermostat 123", req.Selection)
+		}
+		if len(req.Functions) != 1 || req.Functions[0].Type != "resumeProgram" {
+			t.Fatalf("functions in %s, want one resumeProgram", body)
+		}
+		if got, want := string(req.Functions[0].Params["resumeAll"]), fmt.Sprint(resumeAll); got != want {
+			t.Errorf("resumeAll = %s, want %s in %s", got, want, body)
+		}
+	}
+}
+
+func TestResumeProgramStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status": {"code": 3, "message": "Thermostat not found."}}`)
+	}))
+	defer server.Close()
+
+	c := newClient(server.Client(), []ClientOption{WithBaseURL(server.URL), WithLogger(t.Logf)})
+	err := c.ResumeProgram(context.Background(), "123", false)
+	if err == nil || !strings.Contains(err.Error(), "Thermostat not found.") {
+		t.Errorf("ResumeProgram error = %v, want ecobee's status message", err)
+	}
+}
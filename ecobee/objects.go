@@ -63,12 +63,14 @@ type SetHoldParams struct {
 }
 
 type Alert struct {
-	//	AcknowledgeRef       string `json:"acknowledgeRef"`
-	//	Date                 string `json:"date"`
-	//	Time                 string `json:"time"`
-	//	Severity             string `json:"severity"`
-	Text string `json:"text"`
-	//	AlertNumber          int    `json:"alertNumber"`
+	// The omitempty fields are only read from ecobee, and are left out when
+	// an Alert is sent with SendMessage.
+	AcknowledgeRef  string `json:"acknowledgeRef,omitempty"`
+	Date            string `json:"date,omitempty"`
+	Time            string `json:"time,omitempty"`
+	Severity        string `json:"severity,omitempty"`
+	Text            string `json:"text"`
+	AlertNumber     int    `json:"alertNumber,omitempty"`
 	AlertType       string `json:"alertType"`
 	IsOperatorAlert bool   `json:"isOperatorAlert"`
 	// Reminder             string `json:"reminder"`
@@ -78,7 +80,7 @@ type Alert struct {
 	// Acknowledgement      string `json:"acknowledgement"`
 	// RemindMeLater        bool   `json:"remindMeLater"`
 	// ThermostatIdentifier string `json:"thermostatIdentifier"`
-	// NotificationType     string `json:"notificationType"`
+	NotificationType string `json:"notificationType,omitempty"`
 }
 
 type SendMessageParams struct {
@@ -147,16 +149,50 @@ type Thermostat struct {
 	LastModified   string `json:"lastModified"`
 	ThermostatTime string `json:"thermostatTime"`
 	UtcTime        string `json:"utcTime"`
-	// Alerts         []Alert  `json:"alerts"`
-	// Settings       Settings `json:"settings"`
+	/// ...
+	Settings        Settings        `json:"settings"`
+	Location        Location        `json:"location"`
+	Version         Version         `json:"version"`
 	Runtime         Runtime         `json:"runtime"`
 	ExtendedRuntime ExtendedRuntime `json:"extendedRuntime"`
 	/// ...
 	Events  []Event `json:"events"`
 	Program Program `json:"program"`
+	Alerts  []Alert `json:"alerts"`
 	/// ...
-	RemoteSensors []RemoteSensor `json:"remoteSensors"`
-	Weather       Weather        `json:"weather"`
+	RemoteSensors   []RemoteSensor `json:"remoteSensors"`
+	Weather         Weather        `json:"weather"`
+	EquipmentStatus string         `json:"equipmentStatus"`
+}
+
+type Settings struct {
+	HvacMode                string `json:"hvacMode"`
+	Vent                    string `json:"vent"`
+	VentilatorMinOnTime     int    `json:"ventilatorMinOnTime"`
+	VentilatorMinOnTimeHome int    `json:"ventilatorMinOnTimeHome"`
+	VentilatorMinOnTimeAway int    `json:"ventilatorMinOnTimeAway"`
+	VentilatorType          string `json:"ventilatorType"`
+	VentilatorFreeCooling   bool   `json:"ventilatorFreeCooling"`
+	VentilatorDehumidify    bool   `json:"ventilatorDehumidify"`
+	HeatRangeHigh           int    `json:"heatRangeHigh"`
+	HeatRangeLow            int    `json:"heatRangeLow"`
+	CoolRangeHigh           int    `json:"coolRangeHigh"`
+	CoolRangeLow            int    `json:"coolRangeLow"`
+	HeatCoolMinDelta        int    `json:"heatCoolMinDelta"`
+}
+
+type Location struct {
+	TimeZoneOffsetMinutes int    `json:"timeZoneOffsetMinutes"`
+	TimeZone              string `json:"timeZone"`
+	IsDaylightSaving      bool   `json:"isDaylightSaving"`
+	City                  string `json:"city"`
+	ProvinceState         string `json:"provinceState"`
+	Country               string `json:"country"`
+	PostalCode            string `json:"postalCode"`
+}
+
+type Version struct {
+	ThermostatFirmwareVersion string `json:"thermostatFirmwareVersion"`
 }
 
 type Runtime struct {
@@ -224,7 +260,36 @@ type GetRuntimeReportRequest struct {
 	StartDate      string    `json:"startDate"`
 	EndDate        string    `json:"endDate"`
 	Columns        string    `json:"columns"`
-	IncludeSensors bool      `json"includeSensors"`
+	IncludeSensors bool      `json:"includeSensors"`
+}
+
+type CreateRuntimeReportJobRequest struct {
+	Selection      Selection `json:"selection"`
+	StartDate      string    `json:"startDate"`
+	EndDate        string    `json:"endDate"`
+	Columns        string    `json:"columns"`
+	IncludeSensors bool      `json:"includeSensors"`
+}
+
+type CreateRuntimeReportJobResponse struct {
+	JobID  string `json:"jobId"`
+	Status Status `json:"status"`
+}
+
+type GetRuntimeReportJobStatusRequest struct {
+	JobID string `json:"jobId"`
+}
+
+type GetRuntimeReportJobStatusResponse struct {
+	Jobs   []ReportJob `json:"jobs"`
+	Status Status      `json:"status"`
+}
+
+type ReportJob struct {
+	JobID   string   `json:"jobId"`
+	Status  string   `json:"status"`
+	Message string   `json:"message"`
+	Files   []string `json:"files"`
 }
 
 type RuntimeReportResponse struct {
@@ -235,6 +300,7 @@ type RuntimeReportResponse struct {
 	Columns       string   `json:"columns"`
 	ReportList    []Report `json:"reportList"`
 	SensorList    []Sensor `json:"sensorList"`
+	Status        Status   `json:"status"`
 }
 
 type Report struct {
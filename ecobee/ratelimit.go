@@ -0,0 +1,78 @@
+package ecobee
+
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Backoff after being rate limited, when ecobee doesn't say how long to wait.
+// It doubles each time ecobee rate limits us again, up to maxRateLimitBackoff.
+const (
+	minRateLimitBackoff = 5 * time.Second
+	maxRateLimitBackoff = 10 * time.Minute
+)
+
+// waitForRateLimit holds a request back until the backoff from the last time
+// ecobee rate limited us is over, or ctx is done.
+func (c *Client) waitForRateLimit(ctx context.Context) error {
+	c.rateLimitMu.Lock()
+	wait := time.Until(c.rateLimitedUntil)
+	c.rateLimitMu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	glog.V(1).Infof("rate limited, waiting %v before the next request", wait)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// recordRateLimit updates the backoff from the outcome of a request. A
+// RateLimitError starts or extends it, and its RetryAfter is set to the
+// backoff so callers retry no sooner. Anything else ends it.
+func (c *Client) recordRateLimit(err error) {
+	c.rateLimitMu.Lock()
+	defer c.rateLimitMu.Unlock()
+
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		c.rateLimitBackoff = 0
+		return
+	}
+
+	backoff := c.rateLimitBackoff * 2
+	if backoff < minRateLimitBackoff {
+		backoff = minRateLimitBackoff
+	}
+	if backoff > maxRateLimitBackoff {
+		backoff = maxRateLimitBackoff
+	}
+	if rateLimitErr.RetryAfter > backoff {
+		backoff = rateLimitErr.RetryAfter
+	}
+	c.rateLimitBackoff = backoff
+	c.rateLimitedUntil = time.Now().Add(backoff)
+	rateLimitErr.RetryAfter = backoff
+	c.warn("rate limited by ecobee, backing off", "backoff", backoff)
+}
@@ -0,0 +1,77 @@
+package ecobee
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordRateLimitLogs(t *testing.T) {
+	var w warnings
+	c := newClient(nil, []ClientOption{WithLogger(w.log)})
+
+	c.recordRateLimit(errors.New("not rate limited"))
+	if len(w) != 0 {
+		t.Errorf("logged %q for another error, want nothing", w)
+	}
+	c.recordRateLimit(&RateLimitError{})
+	if len(w) != 1 || !strings.Contains(w[0], "rate limited") || !strings.Contains(w[0], minRateLimitBackoff.String()) {
+		t.Errorf("logged %q, want one warning with the %v backoff", w, minRateLimitBackoff)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	c := newClient(server.Client(), []ClientOption{WithBaseURL(server.URL), WithLogger(t.Logf)})
+	_, err := c.GetThermostats(context.Background(), Selection{SelectionType: "registered"})
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("GetThermostats error = %v, want a RateLimitError", err)
+	}
+	if rateLimitErr.RetryAfter != 120*time.Second {
+		t.Errorf("RetryAfter = %v, want 2m0s", rateLimitErr.RetryAfter)
+	}
+
+	// The next request waits out the 120 seconds instead of being sent.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetThermostats(ctx, Selection{SelectionType: "registered"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second GetThermostats error = %v, want it to wait until the deadline", err)
+	}
+	if requests != 1 {
+		t.Errorf("sent %d requests, want 1", requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"", 0},
+		{"120", 120 * time.Second},
+		{"-5", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.in); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %v, want about an hour", date, got)
+	}
+}
@@ -0,0 +1,39 @@
+package ecobee
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordingTransportKeepsRecordings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": {"code": 0}}`))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+
+	// Each run starts with a new transport, as the connector does.
+	for run := 0; run < 2; run++ {
+		client := &http.Client{Transport: &RecordingTransport{Dir: dir}}
+		resp, err := client.Get(server.URL + "/thermostat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	want := []string{"000001-GET-thermostat.json", "000002-GET-thermostat.json"}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] {
+		t.Errorf("recorded %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// equipmentStatusPoller writes the equipment each thermostat is running right
+// now, from the thermostat summary, whenever its runtime revision changes.
+type equipmentStatusPoller struct {
+	client        EcobeeClient
+	influxClient  influxWriter
+	database      string
+	thermostatIDs string
+
+	// Last runtime revision written, by thermostat ID.
+	lastRevision map[string]string
+	// Model and brand, by thermostat ID. The summary doesn't have them, so
+	// they're fetched once for each thermostat.
+	thermostats map[string]ecobee.Thermostat
+}
+
+func newEquipmentStatusPoller(client EcobeeClient, influxClient influxWriter, database, thermostatIDs string) *equipmentStatusPoller {
+	return &equipmentStatusPoller{
+		client:        client,
+		influxClient:  influxClient,
+		database:      database,
+		thermostatIDs: thermostatIDs,
+		lastRevision:  map[string]string{},
+		thermostats:   map[string]ecobee.Thermostat{},
+	}
+}
+
+// equipmentStatusFields has one boolean field per piece of equipment.
+func equipmentStatusFields(es ecobee.EquipmentStatus) map[string]interface{} {
+	return map[string]interface{}{
+		"heat_pump":      es.HeatPump,
+		"heat_pump_2":    es.HeatPump2,
+		"heat_pump_3":    es.HeatPump3,
+		"comp_cool_1":    es.CompCool1,
+		"comp_cool_2":    es.CompCool2,
+		"aux_heat_1":     es.AuxHeat1,
+		"aux_heat_2":     es.AuxHeat2,
+		"aux_heat_3":     es.AuxHeat3,
+		"fan":            es.Fan,
+		"humidifier":     es.Humidifier,
+		"dehumidifier":   es.Dehumidifier,
+		"ventilator":     es.Ventilator,
+		"economizer":     es.Economizer,
+		"comp_hot_water": es.CompHotWater,
+		"aux_hot_water":  es.AuxHotWater,
+	}
+}
+
+// poll fetches the thermostat summary and writes an `ecobee_equipment_status`
+// point for each thermostat whose runtime revision has changed.
+func (p *equipmentStatusPoller) poll(ctx context.Context) error {
+	summary, err := thermostatSummary(ctx, p.client, p.thermostatIDs)
+	if err != nil {
+		return err
+	}
+
+	missing := []string{}
+	for id := range summary {
+		if _, ok := p.thermostats[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		thermostats, err := p.client.GetThermostats(ctx, ecobee.Selection{
+			SelectionType:  "thermostats",
+			SelectionMatch: strings.Join(missing, ","),
+		})
+		if err != nil {
+			return err
+		}
+		for _, t := range thermostats {
+			p.thermostats[t.Identifier] = t
+		}
+	}
+
+	bp, _ := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: p.database})
+	now := time.Now()
+	for id, ts := range summary {
+		if p.lastRevision[id] == ts.RuntimeRevision {
+			continue
+		}
+		tags := thermostatTags(ecobee.Thermostat{
+			Identifier:  id,
+			Name:        ts.Name,
+			ModelNumber: p.thermostats[id].ModelNumber,
+			Brand:       p.thermostats[id].Brand,
+		})
+		pt, err := influxclient.NewPoint("ecobee_equipment_status", tags, equipmentStatusFields(ts.EquipmentStatus), now)
+		if err != nil {
+			return err
+		}
+		bp.AddPoint(pt)
+	}
+	if len(bp.Points()) == 0 {
+		return nil
+	}
+	if err := p.influxClient.Write(bp); err != nil {
+		return err
+	}
+
+	for id, ts := range summary {
+		p.lastRevision[id] = ts.RuntimeRevision
+	}
+	return nil
+}
+
+// run polls every interval until ctx is done.
+func (p *equipmentStatusPoller) run(ctx context.Context, interval time.Duration) {
+	for {
+		if err := p.poll(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Unable to update equipment status: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+func TestEquipmentStatusPollerTags(t *testing.T) {
+	server := newInfluxServer(t)
+	client := &fakeEcobeeClient{
+		thermostats: []ecobee.Thermostat{{Identifier: "123", Name: "Main", ModelNumber: "nikeSmart", Brand: "ecobee"}},
+		summary: map[string]ecobee.ThermostatSummary{
+			"123": {Identifier: "123", Name: "Main", RuntimeRevision: "1", EquipmentStatus: ecobee.EquipmentStatus{Fan: true}},
+		},
+	}
+	u := newTestUpdater(t, Config{ThermostatID: "123"}, client, server)
+	p := newEquipmentStatusPoller(client, u.influxClient, "ecobee", "123")
+	if err := p.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkWritten(t, server.written(),
+		`ecobee_equipment_status,device_id=ecobee-123,receiver=ecobee-influx-connector,thermostat_brand=ecobee,thermostat_model=nikeSmart,thermostat_name=Main `)
+}
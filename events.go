@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// eventPoints creates one `ecobee_event` point per running event (hold,
+// vacation, quick save, etc.) so setpoint overrides show up next to the
+// runtime data they affect. Events are tagged with their type and name, so
+// events running at the same time are kept apart.
+func eventPoints(events []ecobee.Event, meta map[string]string, now time.Time) []*influxclient.Point {
+	points := []*influxclient.Point{}
+	for _, event := range events {
+		if !event.Running {
+			continue
+		}
+
+		tags := map[string]string{
+			"event_type": event.Type,
+			"event_name": event.Name,
+		}
+		for k, v := range meta {
+			tags[k] = v
+		}
+
+		// Hold temperatures are in tenths of a degree. Start and end are in
+		// thermostat time.
+		fields := map[string]interface{}{
+			"heat_hold_temp_°F": float64(event.HeatHoldTemp) / 10,
+			"cool_hold_temp_°F": float64(event.CoolHoldTemp) / 10,
+			"is_vacation":       event.Type == "vacation",
+			"is_quick_save":     event.Type == "quickSave",
+			"start_time":        event.StartDate + " " + event.StartTime,
+			"end_time":          event.EndDate + " " + event.EndTime,
+		}
+
+		pt, err := influxclient.NewPoint("ecobee_event", tags, fields, now)
+		if err != nil {
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points
+}
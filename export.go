@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+)
+
+// The JSON export keeps a copy of every batch written to Influx, one file per
+// thermostat per date range. A manifest records which files have made it into
+// Influx so that anything lost to an Influx outage can be imported later with
+// -reconcile, without fetching it from ecobee again.
+
+const exportManifestFile = "manifest.json"
+
+type exportFile struct {
+	ThermostatID string        `json:"thermostat_id"`
+	StartDate    string        `json:"start_date"`
+	EndDate      string        `json:"end_date"`
+	Points       []exportPoint `json:"points"`
+}
+
+type exportPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+// exportFloat always encodes with a decimal point so that floats and integers
+// can be told apart when the file is read back. Influx rejects a field whose
+// type changes.
+type exportFloat float64
+
+func (f exportFloat) MarshalJSON() ([]byte, error) {
+	s := strconv.FormatFloat(float64(f), 'f', -1, 64)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return []byte(s), nil
+}
+
+// exportManifest maps export file names to whether they were written to Influx.
+type exportManifest map[string]bool
+
+func exportFileName(thermostatID, startDate, endDate string) string {
+	return fmt.Sprintf("%s_%s_%s.json", thermostatID, startDate, endDate)
+}
+
+func loadExportManifest(dir string) (exportManifest, error) {
+	m := exportManifest{}
+	b, err := ioutil.ReadFile(path.Join(dir, exportManifestFile))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// manifestMu serializes manifest updates from concurrent writers.
+var manifestMu sync.Mutex
+
+// markExported records whether an export file has been written to Influx.
+func markExported(dir, name string, written bool) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	m, err := loadExportManifest(dir)
+	if err != nil {
+		return err
+	}
+	m[name] = written
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, exportManifestFile), b, 0o644)
+}
+
+// exportPoints writes the points to a JSON file in `dir`, records in the
+// manifest whether they were written to Influx, and returns the file's name.
+func exportPoints(dir, thermostatID, startDate, endDate string, points []*influxclient.Point, written bool) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	f := exportFile{
+		ThermostatID: thermostatID,
+		StartDate:    startDate,
+		EndDate:      endDate,
+		Points:       []exportPoint{},
+	}
+	for _, pt := range points {
+		fields, err := pt.Fields()
+		if err != nil {
+			return "", err
+		}
+		for k, v := range fields {
+			if fv, ok := v.(float64); ok {
+				fields[k] = exportFloat(fv)
+			}
+		}
+		f.Points = append(f.Points, exportPoint{
+			Measurement: pt.Name(),
+			Tags:        pt.Tags(),
+			Fields:      fields,
+			Time:        pt.Time(),
+		})
+	}
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := exportFileName(thermostatID, startDate, endDate)
+	if err := ioutil.WriteFile(path.Join(dir, name), b, 0o644); err != nil {
+		return "", err
+	}
+	return name, markExported(dir, name, written)
+}
+
+// readExport loads an export file back into batch points.
+func readExport(dir, name, database string) (influxclient.BatchPoints, error) {
+	b, err := ioutil.ReadFile(path.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var f exportFile
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	bp, _ := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: database})
+	for _, p := range f.Points {
+		for k, v := range p.Fields {
+			n, ok := v.(json.Number)
+			if !ok {
+				continue
+			}
+			if strings.ContainsAny(n.String(), ".eE") {
+				p.Fields[k], err = n.Float64()
+			} else {
+				p.Fields[k], err = n.Int64()
+			}
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %s", k, err)
+			}
+		}
+		pt, err := influxclient.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
+		if err != nil {
+			return nil, err
+		}
+		bp.AddPoint(pt)
+	}
+	return bp, nil
+}
+
+// reconcileExports writes every exported file that never made it to Influx.
+func reconcileExports(influxClient influxWriter, dir, database string) error {
+	m, err := loadExportManifest(dir)
+	if err != nil {
+		return fmt.Errorf("unable to read export manifest: %s", err)
+	}
+
+	names := []string{}
+	for name, written := range m {
+		if !written {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		bp, err := readExport(dir, name, database)
+		if err != nil {
+			return fmt.Errorf("unable to read export %s: %s", name, err)
+		}
+		if err := influxClient.Write(bp); err != nil {
+			return fmt.Errorf("unable to write export %s: %s", name, err)
+		}
+		if err := markExported(dir, name, true); err != nil {
+			return fmt.Errorf("unable to update export manifest: %s", err)
+		}
+		log.Printf("Imported %s (%d points).", name, len(bp.Points()))
+	}
+	log.Printf("Reconciled %d exports.", len(names))
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+func TestDoUpdateExports(t *testing.T) {
+	client := &fakeEcobeeClient{
+		reports: map[string][]ecobee.RuntimeReportDataEntry{
+			"123": {{
+				ReportTime: time.Date(2023, 1, 2, 13, 0, 0, 0, time.UTC),
+				DataFields: map[string]string{"zoneAveTemp": "70.5"},
+			}},
+		},
+	}
+	name := exportFileName("123", "2023-01-02", "2023-01-02")
+
+	tests := []struct {
+		name   string
+		fail   bool
+		dryRun bool
+		want   exportManifest
+	}{
+		{"written", false, false, exportManifest{name: true}},
+		{"failed", true, false, exportManifest{name: false}},
+		{"dry run", false, true, exportManifest{}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		server := newInfluxServer(t)
+		server.fail = tt.fail
+		u := newTestUpdater(t, Config{ThermostatID: "123", JSONExportDir: dir}, client, server)
+		u.dryRun = tt.dryRun
+		u.doUpdate(context.Background(), "2023-01-02", "2023-01-02")
+
+		m, err := loadExportManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, tt.want) {
+			t.Errorf("%s: manifest = %v, want %v", tt.name, m, tt.want)
+		}
+		if tt.dryRun {
+			if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+				t.Errorf("%s: saved %d files, want none", tt.name, len(files))
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+)
+
+// asciiFieldSuffixes maps the unit suffixes in field names to the spellings
+// used with field_name_style "ascii". Every field with a unit in its name ends
+// in one of these, so this is the whole mapping: `temperature_°F` becomes
+// `temperature_f`, `humidity_%` becomes `humidity_pct`, and `wind_km/h`
+// becomes `wind_kmh`. Other names are already ASCII and stay the same.
+var asciiFieldSuffixes = []struct {
+	unicode string
+	ascii   string
+}{
+	{"_°F", "_f"},
+	{"_°C", "_c"},
+	{"_%", "_pct"},
+	{"_km/h", "_kmh"},
+}
+
+// asciiFieldName returns the field_name_style "ascii" name for field name.
+// Names that are already ASCII are returned as is.
+func asciiFieldName(name string) string {
+	for _, s := range asciiFieldSuffixes {
+		if strings.HasSuffix(name, s.unicode) {
+			return strings.TrimSuffix(name, s.unicode) + s.ascii
+		}
+	}
+	return name
+}
+
+// asciiFields returns a copy of fields with every name converted by
+// asciiFieldName.
+func asciiFields(fields map[string]interface{}) map[string]interface{} {
+	renamed := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		renamed[asciiFieldName(k)] = v
+	}
+	return renamed
+}
+
+// asciiFieldWriter renames the fields of every point with asciiFieldName
+// before passing it on, so field_name_style applies to every measurement in
+// one place.
+type asciiFieldWriter struct {
+	influxWriter
+}
+
+func (w *asciiFieldWriter) Write(bp influxclient.BatchPoints) error {
+	out, err := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{
+		Precision:        bp.Precision(),
+		Database:         bp.Database(),
+		RetentionPolicy:  bp.RetentionPolicy(),
+		WriteConsistency: bp.WriteConsistency(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, pt := range bp.Points() {
+		fields, err := pt.Fields()
+		if err != nil {
+			return err
+		}
+		renamed, err := influxclient.NewPoint(pt.Name(), pt.Tags(), asciiFields(fields), pt.Time())
+		if err != nil {
+			return err
+		}
+		out.AddPoint(renamed)
+	}
+	return w.influxWriter.Write(out)
+}
+
+// health checks the wrapped writer, if it can be checked.
+func (w *asciiFieldWriter) health() error {
+	if h, ok := w.influxWriter.(interface{ health() error }); ok {
+		return h.health()
+	}
+	return nil
+}
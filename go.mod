@@ -4,8 +4,10 @@ go 1.15
 
 require (
 	github.com/avast/retry-go v3.0.0+incompatible
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/influxdata/influxdb-client-go/v2 v2.2.2
-	github.com/influxdata/influxdb1-client v0.0.0-20220302092344-a9ab5670611c // indirect
+	github.com/influxdata/influxdb1-client v0.0.0-20220302092344-a9ab5670611c
+	github.com/prometheus/client_golang v1.11.1
 	golang.org/x/oauth2 v0.0.0-20210220000619-9bb904979d93
 )
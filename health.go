@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthTracker records how the main loop is doing, for health_listen. The
+// connector is unhealthy once twice the interval before its next poll has
+// passed without a successful one. Polls themselves take time, so the window
+// is never shorter than minHealthWindow.
+type healthTracker struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	deadline    time.Time
+	lastError   string
+}
+
+const minHealthWindow = time.Minute
+
+func newHealthTracker(interval time.Duration) *healthTracker {
+	return &healthTracker{deadline: time.Now().Add(healthWindow(interval))}
+}
+
+func healthWindow(interval time.Duration) time.Duration {
+	if 2*interval < minHealthWindow {
+		return minHealthWindow
+	}
+	return 2 * interval
+}
+
+// success records a successful poll. The next one is expected in interval.
+// A poll that runs more often doesn't shorten the wait for one that runs
+// less often, such as the runtime report once it's caught up.
+func (h *healthTracker) success(interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess = time.Now()
+	if deadline := h.lastSuccess.Add(healthWindow(interval)); deadline.After(h.deadline) {
+		h.deadline = deadline
+	}
+}
+
+// failure records a failed poll.
+func (h *healthTracker) failure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError = err.Error()
+}
+
+// ServeHTTP answers with 200 if the connector is healthy and 503 if not, with
+// the time of the last successful poll and the last error in a JSON body.
+func (h *healthTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	healthy := time.Now().Before(h.deadline)
+	body := map[string]interface{}{
+		"healthy":      healthy,
+		"last_success": nil,
+		"last_error":   h.lastError,
+	}
+	if !h.lastSuccess.IsZero() {
+		body["last_success"] = h.lastSuccess.Format(time.RFC3339)
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// serveHealth serves h at /healthz on addr in the background.
+func serveHealth(addr string, h *healthTracker) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Unable to serve health checks on %s: %s", addr, err)
+		}
+	}()
+}
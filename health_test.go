@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthTracker(t *testing.T) {
+	check := func(h *healthTracker) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		return rec.Code
+	}
+
+	h := newHealthTracker(time.Minute)
+	h.deadline = time.Now().Add(-time.Second)
+	if code := check(h); code != http.StatusServiceUnavailable {
+		t.Errorf("overdue: status %d, want 503", code)
+	}
+
+	// A frequent poll doesn't cut short the wait for a daily one.
+	h.success(24 * time.Hour)
+	h.success(time.Minute)
+	if want := time.Now().Add(47 * time.Hour); h.deadline.Before(want) {
+		t.Errorf("deadline %v, want after %v", h.deadline, want)
+	}
+	if code := check(h); code != http.StatusOK {
+		t.Errorf("after a success: status %d, want 200", code)
+	}
+}
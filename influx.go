@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/avast/retry-go"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+)
+
+// influxWriter writes batches of points to whichever version of InfluxDB is
+// configured. Points are always built with the 1.x client types.
+type influxWriter interface {
+	Write(bp influxclient.BatchPoints) error
+}
+
+// InfluxTarget is one Influx server to write to, for `influx_targets`. The
+// fields mean the same as the top-level config fields with the same names.
+type InfluxTarget struct {
+	Server          string      `json:"influx_server"`
+	User            string      `json:"influx_user,omitempty"`
+	Pass            string      `json:"influx_password,omitempty"`
+	Database        string      `json:"influx_database,omitempty"`
+	RetentionPolicy string      `json:"influx_retention_policy,omitempty"`
+	Version         json.Number `json:"influx_version,omitempty"`
+	Org             string      `json:"influx_org,omitempty"`
+	Bucket          string      `json:"influx_bucket,omitempty"`
+	Token           string      `json:"influx_token,omitempty"`
+}
+
+// influxTargets returns `influx_targets`, or the single target described by
+// the top-level influx_* fields if it is empty.
+func (c Config) influxTargets() []InfluxTarget {
+	if len(c.InfluxTargets) > 0 {
+		return c.InfluxTargets
+	}
+	return []InfluxTarget{{
+		Server:          c.InfluxServer,
+		User:            c.InfluxUser,
+		Pass:            c.InfluxPass,
+		Database:        c.InfluxDatabase,
+		RetentionPolicy: c.InfluxRetentionPolicy,
+		Version:         c.InfluxVersion,
+		Org:             c.InfluxOrg,
+		Bucket:          c.InfluxBucket,
+		Token:           c.InfluxToken,
+	}}
+}
+
+// influxServers returns the servers of every Influx target, for messages.
+func (c Config) influxServers() string {
+	servers := []string{}
+	for _, target := range c.influxTargets() {
+		servers = append(servers, target.Server)
+	}
+	return strings.Join(servers, ", ")
+}
+
+// write1x writes to InfluxDB 1.x, into database and retentionPolicy if they
+// are set and the batch's database and its default retention policy
+// otherwise.
+type write1x struct {
+	client          influxclient.Client
+	database        string
+	retentionPolicy string
+	timeout         time.Duration
+}
+
+func (w *write1x) Write(bp influxclient.BatchPoints) error {
+	// The batch may be written to other targets too, so it is copied rather
+	// than changed.
+	cfg := influxclient.BatchPointsConfig{
+		Precision:        bp.Precision(),
+		Database:         bp.Database(),
+		RetentionPolicy:  bp.RetentionPolicy(),
+		WriteConsistency: bp.WriteConsistency(),
+	}
+	if w.database != "" {
+		cfg.Database = w.database
+	}
+	if w.retentionPolicy != "" {
+		cfg.RetentionPolicy = w.retentionPolicy
+	}
+	out, err := influxclient.NewBatchPoints(cfg)
+	if err != nil {
+		return err
+	}
+	out.AddPoints(bp.Points())
+	return w.client.Write(out)
+}
+
+// health checks that the 1.x server answers a ping.
+func (w *write1x) health() error {
+	_, _, err := w.client.Ping(w.timeout)
+	return err
+}
+
+// write2x writes to InfluxDB 2.x. The batch's database is ignored in favor of
+// the configured org and bucket. Writes use the client's blocking API, so the
+// points are stored before Write returns and the last day written advances.
+// The asynchronous API's Flush doesn't wait for a request already in flight,
+// so influx_v2_batch_size and the other batching options are applied by
+// writeChunked instead.
+type write2x struct {
+	client  influxdb2.Client
+	org     string
+	bucket  string
+	timeout time.Duration
+}
+
+func (w *write2x) Write(bp influxclient.BatchPoints) error {
+	lines := []string{}
+	for _, pt := range bp.Points() {
+		lines = append(lines, pt.String())
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	// The client's own WriteAPIBlocking is shared between calls, and once a
+	// write fails it queues the batch and drops later writes until a retry
+	// delay passes, still returning nil. A new one each time reports every
+	// failure, and writeChunked does the retrying.
+	blocking := api.NewWriteAPIBlocking(w.org, w.bucket, w.client.HTTPService(), w.client.Options().WriteOptions())
+	return blocking.WriteRecord(context.Background(), lines...)
+}
+
+// health checks that the 2.x server is up and ready to take writes.
+func (w *write2x) health() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+	h, err := w.client.Health(ctx)
+	if err != nil {
+		return err
+	}
+	if h.Status != domain.HealthCheckStatusPass {
+		msg := ""
+		if h.Message != nil {
+			msg = *h.Message
+		}
+		return fmt.Errorf("status %s: %s", h.Status, msg)
+	}
+	return nil
+}
+
+// writeOptions controls how writeChunked splits a batch and retries it.
+type writeOptions struct {
+	maxPoints int           // points per write
+	attempts  int           // tries for each write before giving up
+	interval  time.Duration // pause between writes
+}
+
+// defaultWriteOptions are used unless influx_max_points_per_write or the
+// influx_v2_* fields say otherwise.
+var defaultWriteOptions = writeOptions{maxPoints: 5000, attempts: 3}
+
+// writeOptions returns the batching for the configured Influx targets. The
+// influx_v2_* fields only apply when every target is InfluxDB 2.x.
+func (c Config) writeOptions() writeOptions {
+	opts := defaultWriteOptions
+	if c.InfluxMaxPointsPerWrite > 0 {
+		opts.maxPoints = c.InfluxMaxPointsPerWrite
+	}
+	if !c.influxV2() {
+		return opts
+	}
+	if c.InfluxV2BatchSize > 0 {
+		opts.maxPoints = c.InfluxV2BatchSize
+	}
+	if c.InfluxV2MaxRetries > 0 {
+		opts.attempts = c.InfluxV2MaxRetries + 1
+	}
+	opts.interval = time.Duration(c.InfluxV2FlushIntervalMs) * time.Millisecond
+	return opts
+}
+
+// influxV2 reports whether every Influx target is InfluxDB 2.x.
+func (c Config) influxV2() bool {
+	for _, target := range c.influxTargets() {
+		if target.Version != "2" {
+			return false
+		}
+	}
+	return true
+}
+
+// writeChunked writes bp in batches of at most opts.maxPoints points, so large
+// windows don't exceed the server's maximum request size. A batch that fails
+// is tried again on its own before giving up, so that the batches already
+// written don't have to be sent again.
+func writeChunked(w influxWriter, bp influxclient.BatchPoints, opts writeOptions) error {
+	points := bp.Points()
+	for start := 0; start < len(points); start += opts.maxPoints {
+		if start > 0 && opts.interval > 0 {
+			time.Sleep(opts.interval)
+		}
+		end := start + opts.maxPoints
+		if end > len(points) {
+			end = len(points)
+		}
+		chunk, err := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{
+			Precision:        bp.Precision(),
+			Database:         bp.Database(),
+			RetentionPolicy:  bp.RetentionPolicy(),
+			WriteConsistency: bp.WriteConsistency(),
+		})
+		if err != nil {
+			return err
+		}
+		chunk.AddPoints(points[start:end])
+		err = retry.Do(
+			func() error { return w.Write(chunk) },
+			retry.Attempts(uint(opts.attempts)),
+			retry.Delay(time.Second),
+			retry.LastErrorOnly(true),
+		)
+		if err != nil {
+			return fmt.Errorf("points %d to %d of %d: %w", start+1, end, len(points), err)
+		}
+	}
+	return nil
+}
+
+// printWriter prints each point in line protocol instead of writing it, for
+// previewing with -dry-run.
+type printWriter struct {
+	out io.Writer
+}
+
+func (w *printWriter) Write(bp influxclient.BatchPoints) error {
+	for _, pt := range bp.Points() {
+		line, err := lineProtocol(pt)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w.out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+
+var fieldStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// lineProtocol formats pt as one line of line protocol. Tag keys and values
+// go through escapeTagValue, so a thermostat name with a line break in it
+// can't split the point across lines.
+func lineProtocol(pt *influxclient.Point) (string, error) {
+	fields, err := pt.Fields()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(pt.Name()))
+	tags := pt.Tags()
+	tagKeys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			tagKeys = append(tagKeys, k)
+		}
+	}
+	sort.Strings(tagKeys)
+	for _, k := range tagKeys {
+		fmt.Fprintf(&b, ",%s=%s", escapeTagValue(k), escapeTagValue(tags[k]))
+	}
+
+	fieldKeys := make([]string, 0, len(fields))
+	for k := range fields {
+		fieldKeys = append(fieldKeys, k)
+	}
+	sort.Strings(fieldKeys)
+	for i, k := range fieldKeys {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		b.WriteString(sep + escapeTagValue(k) + "=")
+		switch v := fields[k].(type) {
+		case float64:
+			b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case int64:
+			b.WriteString(strconv.FormatInt(v, 10) + "i")
+		case uint64:
+			b.WriteString(strconv.FormatUint(v, 10) + "u")
+		case bool:
+			b.WriteString(strconv.FormatBool(v))
+		case string:
+			b.WriteString(`"` + fieldStringEscaper.Replace(v) + `"`)
+		default:
+			fmt.Fprintf(&b, "%v", v)
+		}
+	}
+	fmt.Fprintf(&b, " %d", pt.Time().UnixNano())
+	return b.String(), nil
+}
+
+// multiWriter writes every batch to each of several targets. A target that
+// fails is logged and skipped; Write only fails if every target does.
+type multiWriter struct {
+	writers []influxWriter
+	servers []string
+}
+
+func (w *multiWriter) Write(bp influxclient.BatchPoints) error {
+	failed := 0
+	var lastErr error
+	for i, target := range w.writers {
+		if err := target.Write(bp); err != nil {
+			logs.error("influx write failed", "server", w.servers[i], "error", err)
+			failed++
+			lastErr = err
+		}
+	}
+	if failed == len(w.writers) {
+		return fmt.Errorf("unable to write to any Influx target: %v", lastErr)
+	}
+	return nil
+}
+
+// health checks every target, and fails only if none of them is healthy.
+func (w *multiWriter) health() error {
+	failed := []string{}
+	for i, target := range w.writers {
+		if h, ok := target.(interface{ health() error }); ok {
+			if err := h.health(); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", w.servers[i], err))
+			}
+		}
+	}
+	if len(failed) == len(w.writers) {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	if len(failed) > 0 {
+		log.Printf("Warning: Influx health check failed for %s.", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// newInfluxWriter creates the writer for the configured Influx targets.
+// Requests that take longer than timeout fail.
+func newInfluxWriter(config Config, timeout time.Duration) (influxWriter, error) {
+	proxy, err := proxyFunc(config.HTTPProxy, config.HTTPSProxy)
+	if err != nil {
+		return nil, err
+	}
+	targets := config.influxTargets()
+	if len(targets) == 1 {
+		return newTargetWriter(targets[0], timeout, proxy)
+	}
+
+	multi := &multiWriter{}
+	for _, target := range targets {
+		w, err := newTargetWriter(target, timeout, proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", target.Server, err)
+		}
+		multi.writers = append(multi.writers, w)
+		multi.servers = append(multi.servers, target.Server)
+	}
+	return multi, nil
+}
+
+// newTargetWriter creates the writer for target's InfluxDB version. Requests
+// are sent through proxy.
+func newTargetWriter(target InfluxTarget, timeout time.Duration, proxy func(*http.Request) (*url.URL, error)) (influxWriter, error) {
+	if target.Version == "2" {
+		// The client's other HTTP options are ignored once a client is set.
+		opts := influxdb2.DefaultOptions().SetHTTPClient(&http.Client{
+			Transport: proxyTransport(proxy),
+			Timeout:   timeout,
+		})
+		return &write2x{
+			client:  influxdb2.NewClientWithOptions(target.Server, target.Token, opts),
+			org:     target.Org,
+			bucket:  target.Bucket,
+			timeout: timeout,
+		}, nil
+	}
+
+	c, err := influxclient.NewHTTPClient(influxclient.HTTPConfig{
+		Addr:     target.Server,
+		Username: target.User,
+		Password: target.Pass,
+		Timeout:  timeout,
+		Proxy:    proxy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &write1x{client: c, database: target.Database, retentionPolicy: target.RetentionPolicy, timeout: timeout}, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWrite2xBlocks(t *testing.T) {
+	server := newInfluxServer(t)
+	w, err := newInfluxWriter(Config{
+		InfluxServer:  server.URL,
+		InfluxVersion: "2",
+		InfluxOrg:     "me",
+		InfluxBucket:  "home",
+		InfluxToken:   "token",
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The points must be stored by the time Write returns, since the last
+	// day written advances right after.
+	if err := w.Write(testBatch(t, "Main")); err != nil {
+		t.Fatal(err)
+	}
+	checkWritten(t, server.written(), "ecobee_runtime_report,thermostat_name=Main ")
+
+	server.mu.Lock()
+	server.fail = true
+	server.mu.Unlock()
+	if err := w.Write(testBatch(t, "Main")); err == nil {
+		t.Error("Write succeeded with the server failing, want an error")
+	}
+}
+
+func TestInfluxTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	for _, version := range []string{"1", "2"} {
+		w, err := newInfluxWriter(Config{
+			InfluxServer:   server.URL,
+			InfluxDatabase: "ecobee",
+			InfluxVersion:  json.Number(version),
+			InfluxOrg:      "me",
+			InfluxBucket:   "home",
+			InfluxToken:    "token",
+		}, 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		if err := w.Write(testBatch(t, "Main")); err == nil {
+			t.Errorf("version %s: Write succeeded against a server that never answers", version)
+		}
+		if err := w.(interface{ health() error }).health(); err == nil {
+			t.Errorf("version %s: health check succeeded against a server that never answers", version)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("version %s: took %v to time out, want about 200ms", version, elapsed)
+		}
+	}
+}
+
+func TestWriteOptions(t *testing.T) {
+	v2 := Config{
+		InfluxVersion:           "2",
+		InfluxMaxPointsPerWrite: 1000,
+		InfluxV2BatchSize:       500,
+		InfluxV2FlushIntervalMs: 250,
+		InfluxV2MaxRetries:      5,
+	}
+	want := writeOptions{maxPoints: 500, attempts: 6, interval: 250 * time.Millisecond}
+	if got := v2.writeOptions(); got != want {
+		t.Errorf("2.x writeOptions() = %+v, want %+v", got, want)
+	}
+
+	v1 := v2
+	v1.InfluxVersion = "1"
+	want = writeOptions{maxPoints: 1000, attempts: 3}
+	if got := v1.writeOptions(); got != want {
+		t.Errorf("1.x writeOptions() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteOptionsValidate(t *testing.T) {
+	config := Config{
+		APIKey:             "key",
+		ThermostatID:       "123",
+		InfluxServer:       "http://localhost:8086",
+		InfluxVersion:      "2",
+		InfluxOrg:          "me",
+		InfluxBucket:       "home",
+		InfluxToken:        "token",
+		InfluxV2BatchSize:  -1,
+		InfluxV2MaxRetries: -1,
+	}
+	if errs := config.Validate(); len(errs) != 2 {
+		t.Errorf("Validate() = %v, want errors for influx_v2_batch_size and influx_v2_max_retries", errs)
+	}
+}
+
+func TestWriteChunked2x(t *testing.T) {
+	server := newInfluxServer(t)
+	config := Config{
+		InfluxServer:       server.URL,
+		InfluxVersion:      "2",
+		InfluxOrg:          "me",
+		InfluxBucket:       "home",
+		InfluxToken:        "token",
+		InfluxV2BatchSize:  2,
+		InfluxV2MaxRetries: 1,
+	}
+	w, err := newInfluxWriter(config, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp := testBatch(t, "Main")
+	bp.AddPoints(testBatch(t, "Upstairs").Points())
+	bp.AddPoints(testBatch(t, "Basement").Points())
+
+	// The first batch fails once and is retried, then the second batch of
+	// one point is written.
+	server.failNext = 1
+	if err := writeChunked(w, bp, config.writeOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if server.requests != 3 {
+		t.Errorf("sent %d requests, want 3", server.requests)
+	}
+	checkWritten(t, server.written(),
+		"ecobee_runtime_report,thermostat_name=Main ",
+		"ecobee_runtime_report,thermostat_name=Upstairs ",
+		"ecobee_runtime_report,thermostat_name=Basement ")
+
+	// Once the retries run out, the write fails.
+	server.failNext = 2
+	if err := writeChunked(w, bp, config.writeOptions()); err == nil {
+		t.Error("writeChunked succeeded after every retry failed, want an error")
+	}
+}
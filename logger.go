@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leveledLogger logs a message with key/value pairs, either as text or as one
+// JSON object per line for log pipelines.
+type leveledLogger struct {
+	mu   sync.Mutex
+	json bool
+	out  io.Writer
+}
+
+// logs is the logger for progress and write errors. main switches it to JSON
+// when log_format is "json".
+var logs = &leveledLogger{out: os.Stderr}
+
+func (l *leveledLogger) info(msg string, kv ...interface{}) {
+	l.log("info", msg, kv)
+}
+
+func (l *leveledLogger) warn(msg string, kv ...interface{}) {
+	l.log("warn", msg, kv)
+}
+
+func (l *leveledLogger) error(msg string, kv ...interface{}) {
+	l.log("error", msg, kv)
+}
+
+func (l *leveledLogger) log(level, msg string, kv []interface{}) {
+	if !l.json {
+		var b strings.Builder
+		if level != "info" {
+			b.WriteString(strings.ToUpper(level) + " ")
+		}
+		b.WriteString(msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+		}
+		log.Print(b.String())
+		return
+	}
+
+	entry := map[string]interface{}{
+		"time":  time.Now().Format(time.RFC3339),
+		"level": level,
+		"msg":   msg,
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := kv[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[fmt.Sprint(kv[i])] = v
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Unable to log %q as JSON: %s", msg, err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(b, '\n'))
+}
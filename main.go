@@ -1,48 +1,215 @@
 package main
 
 import (
-	// "context"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/avast/retry-go"
+	"github.com/golang/glog"
 	influxclient "github.com/influxdata/influxdb1-client/v2"
 
 	"ecobee_influx_connector/ecobee" // taken from https://github.com/rspier/go-ecobee and lightly customized
 )
 
 type Config struct {
-	APIKey                    string `json:"api_key"`
-	WorkDir                   string `json:"work_dir,omitempty"`
-	ThermostatID              string `json:"thermostat_id"`
-	InfluxServer              string `json:"influx_server"`
-	InfluxUser                string `json:"influx_user,omitempty"`
-	InfluxPass                string `json:"influx_password,omitempty"`
-	InfluxDatabase            string `json:"influx_database"`
-	InfluxHealthCheckDisabled bool   `json:"influx_health_check_disabled"`
-	WriteHeatPump1            bool   `json:"write_heat_pump_1"`
-	WriteHeatPump2            bool   `json:"write_heat_pump_2"`
-	WriteAuxHeat1             bool   `json:"write_aux_heat_1"`
-	WriteAuxHeat2             bool   `json:"write_aux_heat_2"`
-	WriteCool1                bool   `json:"write_cool_1"`
-	WriteCool2                bool   `json:"write_cool_2"`
-	WriteHumidifier           bool   `json:"write_humidifier"`
-	AlwaysWriteWeather        bool   `json:"always_write_weather_as_current"`
+	APIKey                    string      `json:"api_key" env:"ECOBEE_API_KEY"`
+	RefreshToken              string      `json:"refresh_token,omitempty" env:"ECOBEE_REFRESH_TOKEN"`
+	WorkDir                   string      `json:"work_dir,omitempty" env:"ECOBEE_WORK_DIR"`
+	StateFile                 string      `json:"state_file,omitempty" env:"ECOBEE_STATE_FILE"`
+	ThermostatID              string      `json:"thermostat_id" env:"ECOBEE_THERMOSTAT_ID"`
+	InfluxServer              string      `json:"influx_server" env:"INFLUX_SERVER"`
+	InfluxUser                string      `json:"influx_user,omitempty" env:"INFLUX_USER"`
+	InfluxPass                string      `json:"influx_password,omitempty" env:"INFLUX_PASSWORD"`
+	InfluxDatabase            string      `json:"influx_database" env:"INFLUX_DATABASE"`
+	InfluxRetentionPolicy     string      `json:"influx_retention_policy,omitempty" env:"INFLUX_RETENTION_POLICY"`
+	InfluxVersion             json.Number `json:"influx_version,omitempty" env:"INFLUX_VERSION"`
+	InfluxOrg                 string      `json:"influx_org,omitempty" env:"INFLUX_ORG"`
+	InfluxBucket              string      `json:"influx_bucket,omitempty" env:"INFLUX_BUCKET"`
+	InfluxToken               string      `json:"influx_token,omitempty" env:"INFLUX_TOKEN"`
+	InfluxTimeout             string      `json:"influx_timeout,omitempty"`
+	InfluxHealthCheckDisabled bool        `json:"influx_health_check_disabled" env:"INFLUX_HEALTH_CHECK_DISABLED"`
+	InfluxMaxPointsPerWrite   int         `json:"influx_max_points_per_write,omitempty"`
+	InfluxV2BatchSize         int         `json:"influx_v2_batch_size,omitempty"`
+	InfluxV2FlushIntervalMs   int         `json:"influx_v2_flush_interval_ms,omitempty"`
+	InfluxV2MaxRetries        int         `json:"influx_v2_max_retries,omitempty"`
+	WriteHeatPump1            bool        `json:"write_heat_pump_1"`
+	WriteHeatPump2            bool        `json:"write_heat_pump_2"`
+	WriteAuxHeat1             bool        `json:"write_aux_heat_1"`
+	WriteAuxHeat2             bool        `json:"write_aux_heat_2"`
+	WriteCool1                bool        `json:"write_cool_1"`
+	WriteCool2                bool        `json:"write_cool_2"`
+	WriteHumidifier           bool        `json:"write_humidifier"`
+	WriteDehumidifier         bool        `json:"write_dehumidifier"`
+	WriteVentilator           bool        `json:"write_ventilator"`
+	WriteEconomizer           bool        `json:"write_economizer"`
+	AlwaysWriteWeather        bool        `json:"always_write_weather_as_current"`
+	ReportJobThresholdDays    int         `json:"report_job_threshold_days,omitempty"`
+	WriteConnectorStatus      bool        `json:"write_connector_status"`
+	ExtraRuntimeColumns       []string    `json:"extra_runtime_columns,omitempty"`
+	WriteClimateTag           bool        `json:"write_climate_tag"`
+	WriteEventTag             bool        `json:"write_event_tag"`
+	ThermostatNameFilter      string      `json:"thermostat_name_filter,omitempty" env:"ECOBEE_THERMOSTAT_NAME_FILTER"`
+	WriteDewpoint             bool        `json:"write_dewpoint"`
+	WriteApparentTemperature  bool        `json:"write_apparent_temperature"`
+	WriteFirmwareVersion      bool        `json:"write_firmware_version"`
+	RunSelfTest               bool        `json:"run_selftest"`
+	WriteEquipmentBitmask     bool        `json:"write_equipment_bitmask"`
+	CounterFields             []string    `json:"counter_fields,omitempty"`
+	WriteComfortScore         bool        `json:"write_comfort_score"`
+	ComfortTempWeight         float64     `json:"comfort_score_temperature_weight,omitempty"`
+	ComfortHumidityWeight     float64     `json:"comfort_score_humidity_weight,omitempty"`
+	JSONExportDir             string      `json:"json_export_dir,omitempty"`
+	RecordAPIResponses        bool        `json:"record_api_responses"`
+	EcobeeAPIURL              string      `json:"ecobee_api_url,omitempty"`
+	HTTPProxy                 string      `json:"http_proxy,omitempty"`
+	HTTPSProxy                string      `json:"https_proxy,omitempty"`
+	ResumeFromInflux          bool        `json:"resume_from_influx"`
+	InitialStartDate          string      `json:"initial_start_date,omitempty"`
+	MetricsListen             string      `json:"metrics_listen,omitempty"`
+	DebugVarsListen           string      `json:"debug_vars_listen,omitempty"`
+	HealthListen              string      `json:"health_listen,omitempty"`
+	MQTTBroker                string      `json:"mqtt_broker,omitempty"`
+	MQTTTopicPrefix           string      `json:"mqtt_topic_prefix,omitempty"`
+	MQTTUsername              string      `json:"mqtt_username,omitempty"`
+	MQTTPassword              string      `json:"mqtt_password,omitempty"`
+	WriteFieldsInclude        []string    `json:"write_fields_include,omitempty"`
+	WriteFieldsExclude        []string    `json:"write_fields_exclude,omitempty"`
+	Units                     string      `json:"units,omitempty"`
+	FieldNameStyle            string      `json:"field_name_style,omitempty"`
+	WriteConcurrency          int         `json:"write_concurrency,omitempty"`
+	LogFormat                 string      `json:"log_format,omitempty"`
+	WriteVentilation          bool        `json:"write_ventilation"`
+	WriteOnlineRatio          bool        `json:"write_online_ratio"`
+	WriteEquipmentStatus      bool        `json:"write_equipment_status"`
+	WriteProgram              bool        `json:"write_program"`
+	WriteWind                 bool        `json:"write_wind"`
+	WriteCumulativeRuntime    bool        `json:"write_cumulative_runtime"`
+	WriteEvents               bool        `json:"write_events"`
+	WriteAlerts               bool        `json:"write_alerts"`
+	EquipmentStatusInterval   string      `json:"equipment_status_interval,omitempty"`
+	WriteChangedOnly          bool        `json:"write_changed_only"`
+	HeartbeatInterval         string      `json:"heartbeat_interval,omitempty"`
+	RetryMaxAttempts          uint        `json:"retry_max_attempts,omitempty"`
+	RetryInitialDelay         string      `json:"retry_initial_delay,omitempty"`
+	RetryMaxDelay             string      `json:"retry_max_delay,omitempty"`
+	PollInterval              string      `json:"poll_interval,omitempty"`
+	CatchUpInterval           string      `json:"catch_up_interval,omitempty"`
+	CatchUpJitter             string      `json:"catch_up_jitter,omitempty"`
+	LiveInterval              string      `json:"live_interval,omitempty"`
+	MetadataRefreshInterval   string      `json:"metadata_refresh_interval,omitempty"`
+	WriteSetpointLimits       bool        `json:"write_setpoint_limits"`
+	WriteSensors              bool        `json:"write_sensors"`
+	CurrentStateInterval      string      `json:"current_state_interval,omitempty"`
+	WriteWeather              bool        `json:"write_weather"`
+
+	// Tags added to every point, on top of the ones the connector sets.
+	StaticTags map[string]string `json:"static_tags,omitempty"`
+
+	// Influx servers to write to instead of the one set by the influx_*
+	// fields above.
+	InfluxTargets []InfluxTarget `json:"influx_targets,omitempty"`
+
+	// Per-thermostat settings, when thermostat_id is given as a list. See
+	// Config.UnmarshalJSON.
+	Thermostats []ThermostatConfig `json:"-"`
 }
 
 const (
 	thermostatNameTag = "thermostat_name"
+
+	// Longest error string written to the connector status measurement.
+	maxStatusErrorLength = 256
 )
 
+// apiFailureTracker counts consecutive failed ecobee API calls so flakiness
+// can be graphed and alerted on before it turns into an outage.
+type apiFailureTracker struct {
+	consecutive int
+	lastError   string
+}
+
+// record notes the result of an API call. A nil error resets the count.
+func (t *apiFailureTracker) record(err error) {
+	if err == nil {
+		t.consecutive = 0
+		return
+	}
+	apiErrorsTotal.Inc()
+	debugAPIErrors.Add(1)
+	t.consecutive++
+	t.lastError = err.Error()
+	if len(t.lastError) > maxStatusErrorLength {
+		t.lastError = t.lastError[:maxStatusErrorLength]
+	}
+}
+
+// newestReportTracker remembers the time of the newest runtime report point
+// written, so the connector can report how far behind real time it is.
+// Thermostats may be written concurrently.
+type newestReportTracker struct {
+	mu     sync.Mutex
+	newest time.Time
+}
+
+// update records t if it is newer than anything seen so far.
+func (n *newestReportTracker) update(t time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if t.After(n.newest) {
+		n.newest = t
+	}
+}
+
+func (n *newestReportTracker) get() time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.newest
+}
+
+// writeConnectorStatus writes the current API failure counts, and how far
+// newest lags behind now, to the `ecobee_connector_status` measurement. The
+// lag is left out if newest is zero.
+func writeConnectorStatus(influxClient influxWriter, database string, t *apiFailureTracker, newest time.Time) {
+	bp, _ := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: database})
+	tags := addStaticTags(map[string]string{
+		"receiver": "ecobee-influx-connector",
+	})
+	fields := map[string]interface{}{
+		"consecutive_api_failures": t.consecutive,
+		"last_api_error":           t.lastError,
+	}
+	if !newest.IsZero() {
+		fields["data_lag_seconds"] = int64(time.Since(newest).Seconds())
+	}
+	pt, err := influxclient.NewPoint("ecobee_connector_status", tags, fields, time.Now())
+	if err != nil {
+		logs.error("connector status point failed", "error", err)
+		return
+	}
+	bp.AddPoint(pt)
+	if err := influxClient.Write(bp); err != nil {
+		logs.error("connector status write failed", "error", err)
+	}
+}
+
 // WindChill calculates the wind chill for the given temperature (in Fahrenheit)
 // and wind speed (in miles/hour). If wind speed is less than 3 mph, or temperature
 // if over 50 degrees, the given temperature is returned - the forumla works
@@ -54,6 +221,173 @@ func WindChill(tempF, windSpeedMph float64) float64 {
 	return 35.74 + (0.6215 * tempF) - (35.75 * math.Pow(windSpeedMph, 0.16)) + (0.4275 * tempF * math.Pow(windSpeedMph, 0.16))
 }
 
+// HeatIndex calculates the heat index (in Fahrenheit) for the given temperature
+// (in Fahrenheit) and relative humidity percentage using the NWS Rothfusz
+// regression, with its adjustments for low and high humidity. Below about 80
+// degrees it uses the NWS's simpler formula instead.
+func HeatIndex(tempF, humidityPct float64) float64 {
+	simple := 0.5 * (tempF + 61.0 + ((tempF - 68.0) * 1.2) + (humidityPct * 0.094))
+	if (simple+tempF)/2 < 80 {
+		return simple
+	}
+
+	t, rh := tempF, humidityPct
+	hi := -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh -
+		0.00683783*t*t - 0.05481717*rh*rh + 0.00122874*t*t*rh +
+		0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+	if rh < 13 && t >= 80 && t <= 112 {
+		hi -= ((13 - rh) / 4) * math.Sqrt((17-math.Abs(t-95))/17)
+	} else if rh > 85 && t >= 80 && t <= 87 {
+		hi += ((rh - 85) / 10) * ((87 - t) / 5)
+	}
+	return hi
+}
+
+// ApparentTemperature returns how warm it feels outside (in Fahrenheit): the
+// wind chill below 50 degrees, the heat index above 80 degrees, and otherwise
+// the temperature itself.
+func ApparentTemperature(tempF, humidityPct, windSpeedMph float64) float64 {
+	switch {
+	case tempF < 50:
+		return WindChill(tempF, windSpeedMph)
+	case tempF > 80:
+		return HeatIndex(tempF, humidityPct)
+	default:
+		return tempF
+	}
+}
+
+// DewPoint calculates the dew point (in Fahrenheit) for the given temperature
+// (in Fahrenheit) and relative humidity percentage using the Magnus formula.
+func DewPoint(tempF, humidityPct float64) float64 {
+	const a = 17.62
+	const b = 243.12
+	tempC := FahrenheitToCelsius(tempF)
+	gamma := math.Log(humidityPct/100) + (a*tempC)/(b+tempC)
+	dewPointC := (b * gamma) / (a - gamma)
+	return dewPointC*9/5 + 32
+}
+
+// FanOnlyRunTime returns how many of the fan's runtime seconds weren't spent
+// heating or cooling, from a runtime report row's fields. Stages overlap, so
+// the longest heating or cooling runtime is subtracted, and the result is
+// never negative. ok is false if the row has no fan runtime.
+func FanOnlyRunTime(fields map[string]interface{}) (seconds int, ok bool) {
+	fan, ok := fields["fan_run_time_s"].(int)
+	if !ok {
+		return 0, false
+	}
+	longest := 0
+	for _, key := range []string{
+		"aux_heat_1_run_time_s",
+		"aux_heat_2_run_time_s",
+		"heat_pump_1_run_time_s",
+		"heat_pump_2_run_time_s",
+		"cool_1_run_time_s",
+		"cool_2_run_time_s",
+	} {
+		if s, ok := fields[key].(int); ok && s > longest {
+			longest = s
+		}
+	}
+	if fan < longest {
+		return 0, true
+	}
+	return fan - longest, true
+}
+
+// Types of runtime report fields.
+const (
+	intField = iota
+	floatField
+	stringField
+)
+
+// runtimeReportFields maps runtime report columns to the Influx fields they
+// are written as.
+var runtimeReportFields = map[string]struct {
+	name string
+	kind int
+}{
+	"auxHeat1":        {"aux_heat_1_run_time_s", intField},
+	"auxHeat2":        {"aux_heat_2_run_time_s", intField},
+	"compCool1":       {"cool_1_run_time_s", intField},
+	"compCool2":       {"cool_2_run_time_s", intField},
+	"compHeat1":       {"heat_pump_1_run_time_s", intField},
+	"compHeat2":       {"heat_pump_2_run_time_s", intField},
+	"humidifier":      {"humidifier_run_time_s", intField},
+	"dehumidifier":    {"dehumidifier_run_time_s", intField},
+	"ventilator":      {"ventilator_run_time_s", intField},
+	"economizer":      {"economizer_run_time_s", intField},
+	"fan":             {"fan_run_time_s", intField},
+	"zoneCoolTemp":    {"setpoint_cool_°F", floatField},
+	"zoneHeatTemp":    {"setpoint_heat_°F", floatField},
+	"zoneAveTemp":     {"temperature_°F", floatField},
+	"zoneHumidity":    {"humidity_%", floatField},
+	"outdoorTemp":     {"outdoor_temperature_°F", floatField},
+	"outdoorHumidity": {"outdoor_humidity_%", floatField},
+	"hvacMode":        {"HVAC_mode", stringField},
+	"zoneClimate":     {"zone_climate", stringField},
+	"wind":            {"wind_km/h", intField},
+	"sky":             {"sky_cover", intField},
+}
+
+// setIntField sets fields[name] to the runtime report value val from column.
+// Values that aren't integers are left out rather than written as zero, and
+// logged at -v=1.
+func setIntField(fields map[string]interface{}, name, column, val string) {
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		glog.V(1).Infof("Skipping %s: invalid %s value %q", name, column, val)
+		return
+	}
+	fields[name] = n
+}
+
+// setFloatField is setIntField for float fields.
+func setFloatField(fields map[string]interface{}, name, column, val string) {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		glog.V(1).Infof("Skipping %s: invalid %s value %q", name, column, val)
+		return
+	}
+	fields[name] = f
+}
+
+// runtimeColumnValue converts a runtime report value for a column with no
+// specific mapping. Numbers are always floats, so a column whose values happen
+// to be whole numbers in one row can't change the Influx field type.
+func runtimeColumnValue(val string) interface{} {
+	if f, err := strconv.ParseFloat(val, 64); err == nil {
+		return f
+	}
+	return val
+}
+
+// SetpointError returns how far tempF is from the setpoint the thermostat is
+// working toward in hvacMode: the heat setpoint when heating and the cool
+// setpoint when cooling. In auto and off modes there's no single setpoint, so
+// ok is false.
+func SetpointError(tempF, heatF, coolF float64, hvacMode string) (errorF float64, ok bool) {
+	switch hvacMode {
+	case "heat", "auxHeatOnly":
+		return tempF - heatF, true
+	case "cool":
+		return tempF - coolF, true
+	}
+	return 0, false
+}
+
+// calendarEventTag returns the event tag for a runtime report row's
+// zoneCalendarEvent: the name of the hold, vacation, or other event the
+// thermostat was following, or "scheduled" if it was following its program.
+func calendarEventTag(event string) string {
+	if strings.TrimSpace(event) == "" {
+		return "scheduled"
+	}
+	return event
+}
+
 // IndoorHumidityRecommendation returns the maximum recommended indoor relative
 // humidity percentage for the given outdoor temperature (in degrees F).
 func IndoorHumidityRecommendation(outdoorTempF float64) int {
@@ -81,26 +415,464 @@ func IndoorHumidityRecommendation(outdoorTempF float64) int {
 	return 15
 }
 
+// resolveThermostatIDs returns a comma separated list of the IDs of all
+// registered thermostats whose names match the filter.
+func resolveThermostatIDs(ctx context.Context, client EcobeeClient, filter *regexp.Regexp) (string, error) {
+	s := ecobee.Selection{
+		SelectionType: "registered",
+	}
+	ts, err := client.GetThermostats(ctx, s)
+	if err != nil {
+		return "", err
+	}
+
+	ids := []string{}
+	for _, t := range ts {
+		if filter.MatchString(t.Name) {
+			ids = append(ids, t.Identifier)
+		}
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("no registered thermostat names match '%s'", filter)
+	}
+	return strings.Join(ids, ","), nil
+}
+
+// thermostatSummary fetches the summary of every registered thermostat in one
+// request and returns the ones in the comma-separated ids. ecobee answers a
+// summary for the whole account as cheaply as for one thermostat.
+func thermostatSummary(ctx context.Context, client EcobeeClient, ids string) (map[string]ecobee.ThermostatSummary, error) {
+	summary, err := client.GetThermostatSummary(ctx, ecobee.Selection{
+		SelectionType:          "registered",
+		IncludeEquipmentStatus: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]ecobee.ThermostatSummary{}
+	for _, id := range strings.Split(ids, ",") {
+		if ts, ok := summary[strings.TrimSpace(id)]; ok {
+			wanted[ts.Identifier] = ts
+		}
+	}
+	return wanted, nil
+}
+
+// checkThermostatIDs makes sure every thermostat in the comma-separated ids is
+// registered to the account, so a typo fails at startup instead of producing
+// empty reports forever.
+func checkThermostatIDs(ctx context.Context, client EcobeeClient, ids string) error {
+	summary, err := client.GetThermostatSummary(ctx, ecobee.Selection{
+		SelectionType:          "registered",
+		IncludeEquipmentStatus: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	available := []string{}
+	for id, ts := range summary {
+		available = append(available, fmt.Sprintf("%s ('%s')", id, ts.Name))
+	}
+	sort.Strings(available)
+	for _, id := range strings.Split(ids, ",") {
+		id = strings.TrimSpace(id)
+		if _, ok := summary[id]; !ok {
+			return fmt.Errorf("thermostat %s not found; available: %s", id, strings.Join(available, ", "))
+		}
+	}
+	return nil
+}
+
+// retryDelay is the default retry backoff, except that when ecobee rate limits
+// us it waits at least as long as the server asked. The client has already
+// logged the rate limit.
+func retryDelay(n uint, err error, config *retry.Config) time.Duration {
+	delay := retry.CombineDelay(retry.BackOffDelay, retry.RandomDelay)(n, err, config)
+	var rateLimitErr *ecobee.RateLimitError
+	if errors.As(err, &rateLimitErr) && rateLimitErr.RetryAfter > delay {
+		return rateLimitErr.RetryAfter
+	}
+	return delay
+}
+
+// isAuthError reports whether err, or any attempt recorded in a retry.Error,
+// is an ecobee.AuthError. Those need the user to re-authorize, so retrying
+// them only burns attempts.
+func isAuthError(err error) bool {
+	var authErr *ecobee.AuthError
+	if errors.As(err, &authErr) {
+		return true
+	}
+	var retryErr retry.Error
+	if errors.As(err, &retryErr) {
+		for _, e := range retryErr {
+			if e != nil && errors.As(e, &authErr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRequestError reports whether err is an ecobee.APIError saying the request
+// itself was bad. Sending the same request again won't help.
+func isRequestError(err error) bool {
+	var apiErr *ecobee.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Code {
+	case ecobee.StatusInvalidRequestFormat, ecobee.StatusTooManyThermostats, ecobee.StatusValidationError,
+		ecobee.StatusInvalidFunction, ecobee.StatusInvalidSelection:
+		return true
+	}
+	return false
+}
+
+// isRetryable reports whether err may go away on its own, so the request is
+// worth sending again: network errors, ecobee server errors, and rate
+// limiting. Auth failures, bad requests, and other HTTP 4xx responses are not.
+func isRetryable(err error) bool {
+	if isAuthError(err) || isRequestError(err) {
+		return false
+	}
+	var httpErr *ecobee.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 &&
+		httpErr.StatusCode != http.StatusRequestTimeout {
+		return false
+	}
+	return true
+}
+
+// ComfortScore rates an interval from 0 (bad) to 100 (perfectly comfortable).
+// It is the weighted average of two scores, each between 0 and 1:
+//
+//   - Temperature: 1 when the temperature is between the heat and cool
+//     setpoints, falling linearly to 0 at 5°F outside of them.
+//   - Humidity: 1 when the humidity is at or below the recommended maximum,
+//     falling linearly to 0 at 20 percentage points above it.
+//
+// If both weights are zero the two scores are weighted equally.
+func ComfortScore(tempF, heatSetpointF, coolSetpointF, humidityPct float64, maxHumidityPct int, tempWeight, humidityWeight float64) float64 {
+	const tempToleranceF = 5.0
+	const humidityTolerancePct = 20.0
+
+	if tempWeight == 0 && humidityWeight == 0 {
+		tempWeight, humidityWeight = 1, 1
+	}
+
+	tempErr := 0.0
+	if tempF < heatSetpointF {
+		tempErr = heatSetpointF - tempF
+	} else if tempF > coolSetpointF {
+		tempErr = tempF - coolSetpointF
+	}
+	tempScore := math.Max(0, 1-tempErr/tempToleranceF)
+
+	humidityErr := math.Max(0, humidityPct-float64(maxHumidityPct))
+	humidityScore := math.Max(0, 1-humidityErr/humidityTolerancePct)
+
+	return 100 * (tempWeight*tempScore + humidityWeight*humidityScore) / (tempWeight + humidityWeight)
+}
+
+// filterFields removes fields not in `include` (if it isn't empty) and fields
+// in `exclude`. Exclude wins when a field is in both. Names match in either
+// field_name_style.
+func filterFields(fields map[string]interface{}, include, exclude []string) {
+	if len(include) > 0 {
+		keep := map[string]bool{}
+		for _, f := range include {
+			keep[asciiFieldName(f)] = true
+		}
+		for f := range fields {
+			if !keep[asciiFieldName(f)] {
+				delete(fields, f)
+			}
+		}
+	}
+	drop := map[string]bool{}
+	for _, f := range exclude {
+		drop[asciiFieldName(f)] = true
+	}
+	for f := range fields {
+		if drop[asciiFieldName(f)] {
+			delete(fields, f)
+		}
+	}
+}
+
+// forEachConcurrently calls fn for each of ids, running at most concurrency
+// calls at once (at least 1). If any calls fail, the rest of the errors are
+// logged and the first is returned.
+func forEachConcurrently(ids []string, concurrency int, fn func(id string) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(id)
+		}(i, id)
+	}
+	wg.Wait()
+
+	var first error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		} else {
+			logs.error("thermostat failed", "thermostat_id", ids[i], "error", err)
+		}
+	}
+	return first
+}
+
+// maxRuntimeReportDays is the longest range ecobee allows in a single runtime
+// report request.
+const maxRuntimeReportDays = 31
+
+// maxHistoryDays is how far back the connector will start when there is no
+// record of the last day written. ecobee doesn't keep runtime data forever.
+const maxHistoryDays = 2 * 365
+
+// withJitter returns d plus a random extra of up to max, so that a long run of
+// requests doesn't arrive at ecobee in lockstep.
+func withJitter(d, max time.Duration) time.Duration {
+	if max <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(max)))
+}
+
+// chunkDateRange splits the days from start to end, inclusive, into
+// consecutive ranges of at most maxDays days. Each range is a first and last
+// day, both inclusive. It returns nil if end is before start.
+func chunkDateRange(start, end time.Time, maxDays int) [][2]time.Time {
+	var chunks [][2]time.Time
+	for !start.After(end) {
+		last := start.AddDate(0, 0, maxDays-1)
+		if last.After(end) {
+			last = end
+		}
+		chunks = append(chunks, [2]time.Time{start, last})
+		start = last.AddDate(0, 0, 1)
+	}
+	return chunks
+}
+
 func main() {
-	configFile := flag.String("config", "", "Configuration JSON file.")
+	configFile := flag.String("config", "", "Configuration JSON file. Optional if the config is set through environment variables.")
 	listThermostats := flag.Bool("list-thermostats", false, "List available thermostats, then exit.")
+	listJSON := flag.Bool("json", false, "With -list-thermostats, print the thermostats as a JSON array.")
+	authorize := flag.Bool("authorize", false, "Print a PIN to authorize the app with as JSON, save the credentials once it's authorized, then exit.")
+	authorizePoll := flag.Bool("poll", false, "With -authorize, check until the PIN is authorized instead of waiting for Enter.")
+	reconcile := flag.Bool("reconcile", false, "Write JSON exports that never reached Influx, then exit.")
+	watchMode := flag.Bool("watch", false, "Continuously print the current state of the thermostats, without writing anywhere.")
+	watchInterval := flag.Duration("watch-interval", 15*time.Second, "How often to refresh in -watch mode.")
+	replayDir := flag.String("replay", "", "Answer ecobee API requests from the recordings in this directory instead of the live API.")
+	backfillStart := flag.String("backfill-start", "", "First day (2006-01-02) to backfill. Requires -backfill-end.")
+	backfillEnd := flag.String("backfill-end", "", "Last day (2006-01-02) to backfill. Requires -backfill-start.")
+	setHold := flag.String("set-hold", "", "Hold this thermostat ID at -hold-heat and -hold-cool, then exit.")
+	holdHeat := flag.Float64("hold-heat", 0, "Heat setpoint (°F) for -set-hold.")
+	holdCool := flag.Float64("hold-cool", 0, "Cool setpoint (°F) for -set-hold.")
+	holdType := flag.String("hold-type", "nextTransition", "How long -set-hold lasts: nextTransition or indefinite.")
+	resumeProgram := flag.String("resume-program", "", "Clear the hold on this thermostat ID and resume its program, then exit.")
+	resumeAll := flag.Bool("resume-all", false, "With -resume-program, clear every stacked hold instead of just the latest.")
+	dryRun := flag.Bool("dry-run", false, "Print points in line protocol instead of writing them to Influx.")
+	once := flag.Bool("once", false, "Fetch everything through yesterday, then exit instead of waiting for new data.")
+	backfillUpdateState := flag.Bool("backfill-update-state", false, "After a backfill, record -backfill-end as the last day written.")
+	dumpCSV := flag.String("dump-csv", "", "Write the runtime report from -backfill-start to -backfill-end to this CSV file instead of to Influx, then exit.")
 	flag.Parse()
 
-	if *configFile == "" {
-		fmt.Println("-config is required.")
-		os.Exit(1)
+	backfill := *backfillStart != "" || *backfillEnd != ""
+	var backfillStartTime, backfillEndTime time.Time
+	if backfill {
+		if *backfillStart == "" || *backfillEnd == "" {
+			log.Fatalf("-backfill-start and -backfill-end must be used together.")
+		}
+		var err error
+		backfillStartTime, err = time.Parse("2006-01-02", *backfillStart)
+		if err != nil {
+			log.Fatalf("Invalid -backfill-start: %s", err)
+		}
+		backfillEndTime, err = time.Parse("2006-01-02", *backfillEnd)
+		if err != nil {
+			log.Fatalf("Invalid -backfill-end: %s", err)
+		}
+		if backfillEndTime.Before(backfillStartTime) {
+			log.Fatalf("-backfill-end (%s) is before -backfill-start (%s).", *backfillEnd, *backfillStart)
+		}
+		today, _ := time.Parse("2006-01-02", time.Now().Format("2006-01-02"))
+		if backfillEndTime.After(today) {
+			log.Fatalf("-backfill-end (%s) is in the future.", *backfillEnd)
+		}
+	}
+	if *dumpCSV != "" {
+		if !backfill {
+			log.Fatalf("-dump-csv requires -backfill-start and -backfill-end.")
+		}
+		if *dryRun || *backfillUpdateState {
+			log.Fatalf("-dump-csv can't be used with -dry-run or -backfill-update-state.")
+		}
 	}
 
+	var err error
 	config := Config{}
-	cfgBytes, err := ioutil.ReadFile(*configFile)
-	if err != nil {
-		log.Fatalf("Unable to read config file '%s': %s", *configFile, err)
+	if *configFile != "" {
+		cfgBytes, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			log.Fatalf("Unable to read config file '%s': %s", *configFile, err)
+		}
+		if err = json.Unmarshal(cfgBytes, &config); err != nil {
+			log.Fatalf("Unable to parse config file '%s': %s", *configFile, err)
+		}
 	}
-	if err = json.Unmarshal(cfgBytes, &config); err != nil {
-		log.Fatalf("Unable to parse config file '%s': %s", *configFile, err)
+	if err := config.loadEnv(); err != nil {
+		log.Fatalf("Unable to read config from the environment: %s", err)
+	}
+	// Listing, watching, and controlling thermostats don't write to Influx,
+	// so they only need the API key.
+	if !*listThermostats && !*watchMode && !*authorize && *setHold == "" && *resumeProgram == "" {
+		if errs := config.Validate(); len(errs) > 0 {
+			for _, err := range errs {
+				log.Printf("Config error: %s", err)
+			}
+			log.Fatalf("Invalid config.")
+		}
 	}
 	if config.APIKey == "" {
-		log.Fatal("api_key must be set in the config file.")
+		log.Fatal("api_key must be set in the config file or ECOBEE_API_KEY.")
+	}
+	if len(config.ExtraRuntimeColumns) > 0 {
+		cols, err := ecobee.NormalizeRuntimeReportColumns(config.ExtraRuntimeColumns)
+		if err != nil {
+			log.Fatalf("Invalid extra_runtime_columns in config file: %s", err)
+		}
+		config.ExtraRuntimeColumns = cols
+	}
+	// Equipment runtime columns that aren't arguments to GetRuntimeReport.
+	for _, equipment := range []struct {
+		column string
+		write  bool
+	}{
+		{"dehumidifier", config.WriteDehumidifier},
+		{"ventilator", config.WriteVentilator || config.WriteVentilation},
+		{"economizer", config.WriteEconomizer},
+	} {
+		if equipment.write {
+			config.ExtraRuntimeColumns = append(config.ExtraRuntimeColumns, equipment.column)
+		}
+	}
+	// zoneCalendarEvent is only kept as a field if it was asked for in
+	// extra_runtime_columns.
+	keepCalendarEventField := false
+	for _, col := range config.ExtraRuntimeColumns {
+		if col == "zoneCalendarEvent" {
+			keepCalendarEventField = true
+		}
+	}
+	if config.WriteEventTag && !keepCalendarEventField {
+		config.ExtraRuntimeColumns = append(config.ExtraRuntimeColumns, "zoneCalendarEvent")
+	}
+	asciiNames := config.FieldNameStyle == "ascii"
+	staticTags = config.StaticTags
+	logs.json = config.LogFormat == "json"
+	pollInterval := 3 * time.Second
+	if config.PollInterval != "" {
+		pollInterval, err = time.ParseDuration(config.PollInterval)
+		if err != nil {
+			log.Fatalf("Invalid poll_interval in config file: %s", err)
+		}
+	}
+	catchUpInterval := pollInterval
+	if config.CatchUpInterval != "" {
+		catchUpInterval, err = time.ParseDuration(config.CatchUpInterval)
+		if err != nil {
+			log.Fatalf("Invalid catch_up_interval in config file: %s", err)
+		}
+	}
+	var catchUpJitter time.Duration
+	if config.CatchUpJitter != "" {
+		catchUpJitter, err = time.ParseDuration(config.CatchUpJitter)
+		if err != nil {
+			log.Fatalf("Invalid catch_up_jitter in config file: %s", err)
+		}
+	}
+	liveInterval := pollInterval
+	if config.LiveInterval != "" {
+		liveInterval, err = time.ParseDuration(config.LiveInterval)
+		if err != nil {
+			log.Fatalf("Invalid live_interval in config file: %s", err)
+		}
+	}
+	metadataRefreshInterval := time.Hour
+	if config.MetadataRefreshInterval != "" {
+		metadataRefreshInterval, err = time.ParseDuration(config.MetadataRefreshInterval)
+		if err != nil {
+			log.Fatalf("Invalid metadata_refresh_interval in config file: %s", err)
+		}
+	}
+	// ecobee asks that the thermostat summary be polled at most every 3 minutes.
+	equipmentStatusInterval := 3 * time.Minute
+	if config.EquipmentStatusInterval != "" {
+		equipmentStatusInterval, err = time.ParseDuration(config.EquipmentStatusInterval)
+		if err != nil {
+			log.Fatalf("Invalid equipment_status_interval in config file: %s", err)
+		}
+	}
+	// Like the equipment status, the current state is polled no more often
+	// than ecobee asks.
+	currentStateInterval := 3 * time.Minute
+	if config.CurrentStateInterval != "" {
+		currentStateInterval, err = time.ParseDuration(config.CurrentStateInterval)
+		if err != nil {
+			log.Fatalf("Invalid current_state_interval in config file: %s", err)
+		}
+	}
+	heartbeatInterval := time.Hour
+	if config.HeartbeatInterval != "" {
+		heartbeatInterval, err = time.ParseDuration(config.HeartbeatInterval)
+		if err != nil {
+			log.Fatalf("Invalid heartbeat_interval in config file: %s", err)
+		}
+	}
+	retryOpts := []retry.Option{
+		retry.DelayType(retryDelay),
+		retry.RetryIf(isRetryable),
+	}
+	if config.RetryMaxAttempts > 0 {
+		retryOpts = append(retryOpts, retry.Attempts(config.RetryMaxAttempts))
+	}
+	if config.RetryInitialDelay != "" {
+		d, err := time.ParseDuration(config.RetryInitialDelay)
+		if err != nil {
+			log.Fatalf("Invalid retry_initial_delay in config file: %s", err)
+		}
+		retryOpts = append(retryOpts, retry.Delay(d))
+	}
+	if config.RetryMaxDelay != "" {
+		d, err := time.ParseDuration(config.RetryMaxDelay)
+		if err != nil {
+			log.Fatalf("Invalid retry_max_delay in config file: %s", err)
+		}
+		retryOpts = append(retryOpts, retry.MaxDelay(d))
+	}
+	var thermostatNameFilter *regexp.Regexp
+	if config.ThermostatNameFilter != "" {
+		thermostatNameFilter, err = regexp.Compile(config.ThermostatNameFilter)
+		if err != nil {
+			log.Fatalf("Invalid thermostat_name_filter in config file: %s", err)
+		}
 	}
 	if config.WorkDir == "" {
 		wd, err := os.Getwd()
@@ -109,216 +881,398 @@ func main() {
 		}
 		config.WorkDir = wd
 	}
+	if err := os.MkdirAll(config.WorkDir, 0o755); err != nil {
+		log.Fatalf("Unable to create work_dir: %s", err)
+	}
+	if config.StateFile == "" {
+		config.StateFile = path.Join(config.WorkDir, "last_data.txt")
+	}
+	// The first day to fetch when nothing has been written yet.
+	today, _ := time.Parse("2006-01-02", time.Now().Format("2006-01-02"))
+	initialStart := today.Add(-7 * 24 * time.Hour)
+	if config.InitialStartDate != "" {
+		initialStart, err = time.Parse("2006-01-02", config.InitialStartDate)
+		if err != nil {
+			log.Fatalf("Invalid initial_start_date in config file: %s", err)
+		}
+	}
+	if earliest := today.Add(-maxHistoryDays * 24 * time.Hour); initialStart.Before(earliest) {
+		log.Printf("initial_start_date %s is too long ago, starting at %s instead.",
+			initialStart.Format("2006-01-02"), earliest.Format("2006-01-02"))
+		initialStart = earliest
+	}
 
-	client := ecobee.NewClient(config.APIKey, path.Join(config.WorkDir, "ecobee-cred-cache"))
+	clientOpts := []ecobee.ClientOption{ecobee.WithLogger(logs.warn)}
+	if config.EcobeeAPIURL != "" {
+		clientOpts = append(clientOpts, ecobee.WithBaseURL(config.EcobeeAPIURL))
+	}
+	// Everything that talks to ecobee, including authorization and token
+	// refreshes, uses http.DefaultTransport.
+	proxy, err := proxyFunc(config.HTTPProxy, config.HTTPSProxy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.DefaultTransport.(*http.Transport).Proxy = proxy
+
+	credCache := path.Join(config.WorkDir, "ecobee-cred-cache")
+	if *authorize {
+		if err := authorizeApp(config.APIKey, credCache, *authorizePoll); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Authorized; saved credentials to %s.", credCache)
+		os.Exit(0)
+	}
+	if config.RefreshToken != "" && *replayDir == "" {
+		if _, err := os.Stat(credCache); os.IsNotExist(err) {
+			if err := ecobee.SaveRefreshToken(config.APIKey, credCache, config.RefreshToken); err != nil {
+				log.Fatalf("Unable to authorize with refresh_token: %s", err)
+			}
+			log.Printf("Authorized with refresh_token; saved credentials to %s.", credCache)
+		}
+	}
+
+	var client *ecobee.Client
+	if *replayDir != "" {
+		client = ecobee.NewReplayClient(*replayDir, clientOpts...)
+	} else if config.RecordAPIResponses {
+		client = ecobee.NewClientWithTransport(config.APIKey, credCache,
+			&ecobee.RecordingTransport{Dir: path.Join(config.WorkDir, "api_recordings")}, clientOpts...)
+	} else {
+		client = ecobee.NewClient(config.APIKey, credCache, clientOpts...)
+	}
 
 	if *listThermostats {
 		s := ecobee.Selection{
 			SelectionType: "registered",
 		}
-		ts, err := client.GetThermostats(s)
+		ts, err := client.GetThermostats(context.Background(), s)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if *listJSON {
+			type listedThermostat struct {
+				Identifier string `json:"identifier"`
+				Name       string `json:"name"`
+				Model      string `json:"model"`
+				Brand      string `json:"brand"`
+			}
+			list := []listedThermostat{}
+			for _, t := range ts {
+				list = append(list, listedThermostat{t.Identifier, t.Name, t.ModelNumber, t.Brand})
+			}
+			if err := json.NewEncoder(os.Stdout).Encode(list); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}
 		for _, t := range ts {
 			fmt.Printf("'%s': ID %s\n", t.Name, t.Identifier)
 		}
 		os.Exit(0)
 	}
 
+	if *setHold != "" {
+		if err := client.SetHold(context.Background(), *setHold, *holdCool, *holdHeat, *holdType); err != nil {
+			log.Fatalf("Unable to set hold: %s", err)
+		}
+		log.Printf("Holding thermostat %s at %.1f°F heat, %.1f°F cool.", *setHold, *holdHeat, *holdCool)
+		os.Exit(0)
+	}
+
+	if *resumeProgram != "" {
+		if err := client.ResumeProgram(context.Background(), *resumeProgram, *resumeAll); err != nil {
+			log.Fatalf("Unable to resume program: %s", err)
+		}
+		log.Printf("Resumed the program on thermostat %s.", *resumeProgram)
+		os.Exit(0)
+	}
+
+	if thermostatNameFilter != nil {
+		ids, err := resolveThermostatIDs(context.Background(), client, thermostatNameFilter)
+		if err != nil {
+			log.Fatalf("Unable to resolve thermostat_name_filter: %s", err)
+		}
+		log.Printf("Thermostats matching '%s': %s", config.ThermostatNameFilter, ids)
+		config.ThermostatID = ids
+	}
 	if config.ThermostatID == "" {
-		log.Fatalf("thermostat_id must be set in the config file.")
+		log.Fatalf("thermostat_id or thermostat_name_filter must be set in the config file.")
 	}
-	if config.InfluxServer == "" {
-		log.Fatalf("influx_server must be set in the config file.")
+	if thermostatNameFilter == nil {
+		if err := checkThermostatIDs(context.Background(), client, config.ThermostatID); err != nil {
+			log.Fatalf("Unable to check thermostat_id: %s", err)
+		}
+	}
+
+	if *watchMode {
+		watch(client, config.ThermostatID, *watchInterval)
 	}
 
 	// Influx
-	const influxTimeout = 3 * time.Second
+	influxTimeout := 3 * time.Second
+	if config.InfluxTimeout != "" {
+		influxTimeout, err = time.ParseDuration(config.InfluxTimeout)
+		if err != nil {
+			log.Fatalf("Invalid influx_timeout in config file: %s", err)
+		}
+	}
 
-	influxClient, err := influxclient.NewHTTPClient(influxclient.HTTPConfig{
-		Addr:     config.InfluxServer,
-		Username: config.InfluxUser,
-		Password: config.InfluxPass,
-	})
+	var influxClient influxWriter
+	csvOut := &csvWriter{}
+	if *dumpCSV != "" {
+		influxClient = csvOut
+	} else if *dryRun {
+		influxClient = &printWriter{out: os.Stdout}
+	} else {
+		influxClient, err = newInfluxWriter(config, influxTimeout)
+		if err != nil {
+			log.Fatalf("Unable to create Influx client: %s", err)
+		}
+	}
+	if asciiNames {
+		influxClient = &asciiFieldWriter{influxClient}
+	}
 
-	doUpdate := func(start_str string, end_str string) {
-		if err := retry.Do(
-			func() error {
-				s := ecobee.Selection{
-					SelectionType:  "thermostats",
-					SelectionMatch: config.ThermostatID,
-
-					IncludeAlerts:          false,
-					IncludeEvents:          false,
-					IncludeProgram:         false,
-					IncludeRuntime:         false,
-					IncludeExtendedRuntime: false,
-					IncludeSettings:        false,
-					IncludeSensors:         false,
-					IncludeWeather:         false,
-				}
-				thermostats, err := client.GetThermostats(s)
-				if err != nil {
-					return err
-				}
+	if w, ok := influxClient.(interface{ health() error }); ok && !config.InfluxHealthCheckDisabled {
+		if err := w.health(); err != nil {
+			log.Fatalf("Influx server %s failed its health check: %s (set influx_health_check_disabled to skip this check)", config.influxServers(), err)
+		}
+	}
 
-				thermostat_metadata := map[string]map[string]string{}
-				for _, t := range thermostats {
-					meta := map[string]string{
-						"thermostat_name":  t.Name,
-						"thermostat_model": t.ModelNumber,
-						"thermostat_brand": t.Brand,
-					}
+	if *reconcile {
+		if config.JSONExportDir == "" {
+			log.Fatalf("json_export_dir must be set in the config file to reconcile.")
+		}
+		if err := reconcileExports(influxClient, config.JSONExportDir, config.InfluxDatabase); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 
-					thermostat_metadata[t.Identifier] = meta
-				}
+	if config.RunSelfTest && !*dryRun && *dumpCSV == "" {
+		if err := runSelfTest(influxClient, config.InfluxDatabase); err != nil {
+			log.Fatalf("Influx self-test failed: %s", err)
+		}
+		log.Printf("Influx self-test passed.")
+	}
+
+	if config.MetricsListen != "" {
+		serveMetrics(config.MetricsListen)
+	}
+	if config.DebugVarsListen != "" {
+		serveDebugVars(config.DebugVarsListen)
+	}
+	health := newHealthTracker(pollInterval)
+	if config.HealthListen != "" {
+		serveHealth(config.HealthListen, health)
+	}
+
+	updates := newUpdater(config, client, influxClient)
+	updates.dryRun = *dryRun || *dumpCSV != ""
+	// Nothing is published for points that are only printed or saved to CSV.
+	if !*dryRun && *dumpCSV == "" {
+		publisher, err := newRuntimePublisher(config)
+		if err != nil {
+			log.Fatalf("Unable to create MQTT client: %s", err)
+		}
+		updates.publisher = publisher
+	}
+	updates.retryOpts = retryOpts
+	updates.metadataRefreshInterval = metadataRefreshInterval
+	updates.keepCalendarEventField = keepCalendarEventField
+
+	// Stop cleanly on SIGINT/SIGTERM. A batch that is being written is allowed
+	// to finish, but nothing new is started.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down.", sig)
+		cancel()
+	}()
+
+	if config.WriteEquipmentStatus {
+		poller := newEquipmentStatusPoller(client, influxClient, config.InfluxDatabase, config.ThermostatID)
+		go poller.run(ctx, equipmentStatusInterval)
+	}
+
+	reauthorizeRequired := func(err error) {
+		log.Fatalf("ecobee rejected the saved credentials: %s\nDelete %s and run with -list-thermostats at an interactive terminal to authorize again.",
+			err, path.Join(config.WorkDir, "ecobee-cred-cache"))
+	}
 
-				report_data, rr_err := client.GetRuntimeReport(config.ThermostatID,
-					start_str, end_str,
-					config.WriteHumidifier,
-					config.WriteAuxHeat1,
-					config.WriteAuxHeat2,
-					config.WriteHeatPump1,
-					config.WriteHeatPump2,
-					config.WriteCool1,
-					config.WriteCool2)
-
-				_ = rr_err
-
-				// fmt.Printf("\n\n%v\n\n", report_data);
-
-				for thermostat_id, entries := range report_data {
-
-					meta := map[string]string{
-						"device_id": fmt.Sprintf("ecobee-%s", thermostat_id),
-						"receiver":  "ecobee-influx-connector",
-					}
-
-					// Copy in the thermostat data from the getThermostats call.
-					for k, v := range thermostat_metadata[thermostat_id] {
-						meta[k] = v
-					}
-
-					bp, _ := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: config.InfluxDatabase})
-
-					if entries_ok, ok := entries.([]ecobee.RuntimeReportDataEntry); ok {
-						for _, entry := range entries_ok {
-
-							fields := map[string]interface{}{}
-
-							for key, val := range entry.DataFields {
-								if key == "auxHeat1" {
-									fields["aux_heat_1_run_time_s"], _ = strconv.Atoi(val)
-								} else if key == "auxHeat2" {
-									fields["aux_heat_2_run_time_s"], _ = strconv.Atoi(val)
-								} else if key == "compCool1" {
-									fields["cool_1_run_time_s"], _ = strconv.Atoi(val)
-								} else if key == "compCool2" {
-									fields["cool_2_run_time_s"], _ = strconv.Atoi(val)
-								} else if key == "compHeat1" {
-									fields["heat_pump_1_run_time_s"], _ = strconv.Atoi(val)
-								} else if key == "compHeat2" {
-									fields["heat_pump_2_run_time_s"], _ = strconv.Atoi(val)
-								} else if key == "humidifier" {
-									fields["humidifier_run_time_s"], _ = strconv.Atoi(val)
-								} else if key == "zoneCoolTemp" {
-									fields["setpoint_cool_°F"], _ = strconv.ParseFloat(val, 64)
-								} else if key == "zoneHeatTemp" {
-									fields["setpoint_heat_°F"], _ = strconv.ParseFloat(val, 64)
-								} else if key == "zoneAveTemp" {
-									fields["temperature_°F"], _ = strconv.ParseFloat(val, 64)
-								} else if key == "zoneHumidity" {
-									fields["humidity_%"], _ = strconv.ParseFloat(val, 64)
-								} else if key == "outdoorTemp" {
-									fields["outdoor_temperature_°F"], _ = strconv.ParseFloat(val, 64)
-								} else if key == "outdoorHumidity" {
-									fields["outdoor_humidity_%"], _ = strconv.ParseFloat(val, 64)
-								} else if key == "HVACmode" {
-									fields["HVAC_mode"] = val
-								} else if key == "zoneClimate" {
-									fields["zone_climate"] = val
-								} else if key == "fan" {
-									fields["fan_run_time_s"], _ = strconv.Atoi(val)
-								} else if key == "wind" {
-									fields["wind_km/h"], _ = strconv.Atoi(val)
-								} else if key == "sky" {
-									fields["sky_cover"], _ = strconv.Atoi(val)
-								} else {
-									fmt.Printf("%v = %v\n", key, val);
-								}
-							}
-
-							pt, _ := influxclient.NewPoint("ecobee_runtime_report", meta, fields, entry.ReportTime)
-							bp.AddPoint(pt)
-							// fmt.Printf("added point %v\n", entry.ReportTime);
-
-						}
-					}
-
-					fmt.Printf("writing\n")
-
-					err := influxClient.Write(bp)
-					if err != nil {
-						fmt.Printf("ERROR writing\n")
-						fmt.Printf("Unexpected error during Write: %v", err)
-						return err
-					}
-					fmt.Printf("runtime write good\n")
+	// Update collected time.
+	// In a dry run the state file is left alone, but the main loop still
+	// needs to move on to the next window.
+	dryRunState := ""
+	writeState := func(end_str string) {
+		if *dryRun {
+			dryRunState = end_str
+			return
+		}
+		_ = ioutil.WriteFile(config.StateFile, []byte(end_str+"\n"), 0o644)
+	}
 
+	// sleep waits for d, or until the connector is shutting down.
+	sleep := func(d time.Duration) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(d):
+		}
+	}
+
+	if backfill {
+		failed := []string{}
+		for _, window := range chunkDateRange(backfillStartTime, backfillEndTime, maxRuntimeReportDays) {
+			start_str := window[0].Format("2006-01-02")
+			end_str := window[1].Format("2006-01-02")
+
+			logs.info("backfilling", "date_range", start_str+".."+end_str)
+
+			if err := updates.doUpdate(ctx, start_str, end_str); err != nil {
+				if ctx.Err() != nil {
+					log.Printf("Backfill interrupted before %s.", start_str)
+					os.Exit(1)
 				}
+				if isAuthError(err) {
+					reauthorizeRequired(err)
+				}
+				logs.error("backfill failed", "date_range", start_str+".."+end_str, "error", err)
+				failed = append(failed, start_str+" to "+end_str)
+			}
+			sleep(withJitter(catchUpInterval, catchUpJitter))
+		}
+		if len(failed) > 0 {
+			log.Fatalf("Backfill failed for %s.", strings.Join(failed, ", "))
+		}
+		if *backfillUpdateState {
+			writeState(*backfillEnd)
+		}
+		if *dumpCSV != "" {
+			if err := csvOut.save(*dumpCSV); err != nil {
+				log.Fatalf("Unable to write %s: %s", *dumpCSV, err)
+			}
+			log.Printf("Wrote %d rows to %s.", len(csvOut.points), *dumpCSV)
+		}
+		log.Printf("Backfill from %s to %s complete.", *backfillStart, *backfillEnd)
+		os.Exit(0)
+	}
 
-				return nil
-			},
-		); err != nil {
-			log.Fatal(err)
+	if config.ResumeFromInflux {
+		day, err := resumeDayFromInflux(influxClient, config.ThermostatID)
+		if err != nil {
+			log.Printf("Unable to find the last day in Influx, using %s instead: %s", config.StateFile, err)
+		} else if day == "" {
+			log.Printf("No runtime reports in Influx for every thermostat yet, using %s instead.", config.StateFile)
 		} else {
-			// Update collected time.
-			_ = ioutil.WriteFile("./last_data.txt", []byte(end_str+"\n"), 0o644)
+			log.Printf("Resuming after %s, the last day in Influx.", day)
+			writeState(day)
 		}
 	}
 
-	for true {
+	// The current state doesn't depend on the runtime report, so it's
+	// written on its own schedule.
+	var changes *changeTracker
+	if config.WriteChangedOnly {
+		changes = newChangeTracker(heartbeatInterval)
+	}
+	if state := newCurrentStatePoller(config, client, influxClient, changes); state.enabled() {
+		state.health = health
+		if *once {
+			if err := state.poll(ctx); err != nil {
+				logs.error("current state update failed", "error", err)
+			}
+		} else {
+			go state.run(ctx, currentStateInterval)
+		}
+	}
+
+	live := false
+	for ctx.Err() == nil {
 		// Get the date of the last day we have gotten data for.
-		lastDataBytes, _ := ioutil.ReadFile("./last_data.txt")
+		lastDataBytes, _ := ioutil.ReadFile(config.StateFile)
 		lastData := strings.TrimSpace(string(lastDataBytes))
+		if dryRunState != "" {
+			lastData = dryRunState
+		}
 
 		// See if there is a day that is over that we have not gotten data for yet.
 		now := time.Now()
 		yesterday_time := now.Add(-24 * time.Hour)
 		yesterday_string := yesterday_time.Format("2006-01-02")
 
-		left_off, _ := time.Parse("2006-01-02", lastData)
+		left_off, err := time.Parse("2006-01-02", lastData)
+		if err != nil {
+			// Nothing has been written yet.
+			left_off = initialStart.Add(-24 * time.Hour)
+		} else {
+			// Until this run writes something, the newest data is the last
+			// interval of the last day written.
+			updates.newestWritten.update(left_off.Add(24*time.Hour - 5*time.Minute))
+		}
+		debugLastData.Set(left_off.Format("2006-01-02"))
 		yesterday, _ := time.Parse("2006-01-02", yesterday_string)
 
 		if !left_off.Before(yesterday) {
-			fmt.Printf("Nothing to do!\n")
-
-			// Go ahead and exit now.
-			os.Exit(0)
+			if *once {
+				log.Printf("Caught up through %s.", left_off.Format("2006-01-02"))
+				os.Exit(0)
+			}
+			// Caught up, so only check back occasionally for the next day.
+			if !live {
+				log.Printf("Caught up through %s; checking for new data every %v.", left_off.Format("2006-01-02"), liveInterval)
+				live = true
+			}
+			// Keep recording the lag while there's nothing to fetch.
+			if config.WriteConnectorStatus {
+				writeConnectorStatus(influxClient, config.InfluxDatabase, updates.apiFailures, updates.newestWritten.get())
+			}
+			sleep(liveInterval)
+			continue
 		}
+		live = false
 
 		// There is data we need to collect and push to influx.
 
 		// Start date is the day after the last day, starting at midnight.
 		start := left_off.Add(24 * time.Hour)
-		// See if we can do up to 2 weeks of data.
-		projected_end := start.Add(14 * 24 * time.Hour)
-		end := projected_end
-		if projected_end.After(yesterday) {
-			// Projected end is into the future. So we just go up until yesterday.
-			end = yesterday
-		}
+		// Do up to 2 weeks of data, stopping at yesterday.
+		window := chunkDateRange(start, yesterday, 14)[0]
 
-		start_str := start.Format("2006-01-02")
-		end_str := end.Format("2006-01-02")
+		start_str := window[0].Format("2006-01-02")
+		end_str := window[1].Format("2006-01-02")
 
-		fmt.Printf("Start: %s\n", start_str)
-		fmt.Printf("End:   %s\n", end_str)
+		logs.info("fetching", "date_range", start_str+".."+end_str)
 
-		doUpdate(start_str, end_str)
+		if err := updates.doUpdate(ctx, start_str, end_str); err != nil {
+			if isAuthError(err) {
+				reauthorizeRequired(err)
+			}
+			if ctx.Err() == nil {
+				// Try this range again on the next poll.
+				logs.error("update failed", "date_range", start_str+".."+end_str, "error", err)
+				health.failure(err)
+			}
+			if *once {
+				os.Exit(1)
+			}
+		} else {
+			writeState(end_str)
+			if end_str == yesterday_string {
+				// Caught up, so the next update is once today is over.
+				tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+				health.success(time.Until(tomorrow) + liveInterval)
+			} else {
+				health.success(catchUpInterval)
+			}
+		}
 
-		// Wait 3 seconds.
-		time.Sleep(3 * time.Second)
+		// -once ignores the interval and goes straight to the next window.
+		if !*once {
+			sleep(withJitter(catchUpInterval, catchUpJitter))
+		}
 	}
+	log.Printf("Shut down.")
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avast/retry-go"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// reportFields runs an update with config for a single runtime report row
+// with the given columns, and returns the fields written for it.
+func reportFields(t *testing.T, config Config, columns map[string]string) map[string]string {
+	t.Helper()
+	server := newInfluxServer(t)
+	client := &fakeEcobeeClient{
+		reports: map[string][]ecobee.RuntimeReportDataEntry{
+			"123": {{
+				ReportTime:     time.Date(2023, 1, 2, 13, 0, 0, 0, time.UTC),
+				ThermostatTime: time.Date(2023, 1, 2, 8, 0, 0, 0, time.UTC),
+				DataFields:     columns,
+			}},
+		},
+	}
+	config.ThermostatID = "123"
+	u := newTestUpdater(t, config, client, server)
+	if err := u.doUpdate(context.Background(), "2023-01-02", "2023-01-02"); err != nil {
+		t.Fatalf("doUpdate: %v", err)
+	}
+
+	lines := server.written()
+	if len(lines) != 1 {
+		t.Fatalf("wrote %q, want one line", lines)
+	}
+	// measurement,tags fields time, where only the tags may hold escaped
+	// spaces.
+	line := strings.Replace(lines[0], `\ `, "_", -1)
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		t.Fatalf("can't parse %q", lines[0])
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(field, "=", 2)
+		fields[kv[0]] = kv[1]
+	}
+	return fields
+}
+
+// writtenFloat returns the float value of field name, failing if it is
+// missing.
+func writtenFloat(t *testing.T, fields map[string]string, name string) float64 {
+	t.Helper()
+	v, ok := fields[name]
+	if !ok {
+		t.Fatalf("fields %v have no %s", fields, name)
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		t.Fatalf("%s = %q: %v", name, v, err)
+	}
+	return f
+}
+
+func TestDewPoint(t *testing.T) {
+	// Reference values from the NWS dew point calculator.
+	tests := []struct {
+		tempF, humidityPct, want float64
+	}{
+		{70, 50, 50.5},
+		{90, 70, 79.0},
+		{50, 80, 44.1},
+		{80, 20, 35.3},
+		{32, 100, 32.0},
+	}
+	for _, tt := range tests {
+		if got := DewPoint(tt.tempF, tt.humidityPct); math.Abs(got-tt.want) > 0.5 {
+			t.Errorf("DewPoint(%v, %v) = %.1f, want %.1f ± 0.5", tt.tempF, tt.humidityPct, got, tt.want)
+		}
+	}
+}
+
+func TestDoUpdateDewpoint(t *testing.T) {
+	columns := map[string]string{
+		"zoneAveTemp":     "70",
+		"zoneHumidity":    "50",
+		"outdoorTemp":     "50",
+		"outdoorHumidity": "80",
+	}
+	fields := reportFields(t, Config{WriteDewpoint: true}, columns)
+	if got := writtenFloat(t, fields, "indoor_dewpoint_°F"); math.Abs(got-50.5) > 0.5 {
+		t.Errorf("indoor_dewpoint_°F = %.1f, want 50.5", got)
+	}
+	if got := writtenFloat(t, fields, "outdoor_dewpoint_°F"); math.Abs(got-44.1) > 0.5 {
+		t.Errorf("outdoor_dewpoint_°F = %.1f, want 44.1", got)
+	}
+
+	// Metric converts the dew point along with every other temperature.
+	fields = reportFields(t, Config{WriteDewpoint: true, Units: "metric"}, columns)
+	if got := writtenFloat(t, fields, "outdoor_dewpoint_°C"); math.Abs(got-6.7) > 0.3 {
+		t.Errorf("outdoor_dewpoint_°C = %.1f, want 6.7", got)
+	}
+
+	// Missing outdoor humidity means no outdoor dew point.
+	delete(columns, "outdoorHumidity")
+	fields = reportFields(t, Config{WriteDewpoint: true}, columns)
+	if v, ok := fields["outdoor_dewpoint_°F"]; ok {
+		t.Errorf("outdoor_dewpoint_°F = %s without outdoor humidity, want none", v)
+	}
+	if _, ok := fields["indoor_dewpoint_°F"]; !ok {
+		t.Errorf("fields %v have no indoor_dewpoint_°F", fields)
+	}
+}
+
+func TestRetryDelayHonorsRetryAfter(t *testing.T) {
+	var delays []time.Duration
+	attempts := 0
+	err := retry.Do(
+		func() error {
+			attempts++
+			if attempts == 1 {
+				return &ecobee.RateLimitError{RetryAfter: 120 * time.Second}
+			}
+			return nil
+		},
+		retry.Delay(time.Second),
+		retry.MaxJitter(time.Second),
+		retry.DelayType(func(n uint, err error, config *retry.Config) time.Duration {
+			delays = append(delays, retryDelay(n, err, config))
+			return 0
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delays) != 1 || delays[0] != 120*time.Second {
+		t.Errorf("delays = %v, want [2m0s]", delays)
+	}
+}
+
+func TestComfortScore(t *testing.T) {
+	tests := []struct {
+		name                          string
+		tempF, heatF, coolF, humidity float64
+		maxHumidity                   int
+		tempWeight, humidityWeight    float64
+		want                          float64
+	}{
+		{"perfectly comfortable", 70, 68, 75, 40, 45, 1, 1, 100},
+		{"at the setpoints and the humidity limit", 75, 68, 75, 45, 45, 1, 1, 100},
+		{"badly off", 85, 68, 75, 80, 45, 1, 1, 0},
+		{"too cold", 60, 68, 75, 40, 45, 1, 1, 50},
+		{"halfway off", 77.5, 68, 75, 55, 45, 1, 1, 50},
+		{"weighted toward temperature", 77.5, 68, 75, 40, 45, 3, 1, 62.5},
+		{"no weights", 77.5, 68, 75, 40, 45, 0, 0, 75},
+	}
+	for _, tt := range tests {
+		got := ComfortScore(tt.tempF, tt.heatF, tt.coolF, tt.humidity, tt.maxHumidity, tt.tempWeight, tt.humidityWeight)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: ComfortScore = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDoUpdateComfortScore(t *testing.T) {
+	columns := map[string]string{
+		"zoneAveTemp":  "70",
+		"zoneHeatTemp": "68",
+		"zoneCoolTemp": "75",
+		"zoneHumidity": "40",
+		"outdoorTemp":  "60",
+	}
+	fields := reportFields(t, Config{WriteComfortScore: true}, columns)
+	if got := writtenFloat(t, fields, "comfort_score"); got != 100 {
+		t.Errorf("comfort_score = %v, want 100", got)
+	}
+
+	columns["zoneAveTemp"] = "85"
+	columns["zoneHumidity"] = "80"
+	fields = reportFields(t, Config{WriteComfortScore: true}, columns)
+	if got := writtenFloat(t, fields, "comfort_score"); got != 0 {
+		t.Errorf("comfort_score = %v, want 0", got)
+	}
+}
+
+func TestChunkDateRange(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		days       int
+		wantChunks int
+		lastDays   int
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{31, 1, 31},
+		{32, 2, 1},
+		{400, 13, 28},
+	}
+	for _, tt := range tests {
+		end := start.AddDate(0, 0, tt.days-1)
+		chunks := chunkDateRange(start, end, 31)
+		if len(chunks) != tt.wantChunks {
+			t.Errorf("%d days: got %d chunks, want %d", tt.days, len(chunks), tt.wantChunks)
+			continue
+		}
+		if len(chunks) == 0 {
+			continue
+		}
+
+		// The chunks cover every day once, in order, 31 days at a time.
+		next := start
+		for i, c := range chunks {
+			if !c[0].Equal(next) {
+				t.Errorf("%d days: chunk %d starts %s, want %s", tt.days, i, c[0].Format("2006-01-02"), next.Format("2006-01-02"))
+			}
+			days := int(c[1].Sub(c[0]).Hours()/24) + 1
+			want := 31
+			if i == len(chunks)-1 {
+				want = tt.lastDays
+			}
+			if days != want {
+				t.Errorf("%d days: chunk %d has %d days, want %d", tt.days, i, days, want)
+			}
+			next = c[1].AddDate(0, 0, 1)
+		}
+		if !chunks[len(chunks)-1][1].Equal(end) {
+			t.Errorf("%d days: last chunk ends %s, want %s", tt.days, chunks[len(chunks)-1][1].Format("2006-01-02"), end.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestAuthErrorNotRetried(t *testing.T) {
+	attempts := 0
+	err := retry.Do(
+		func() error {
+			attempts++
+			return fmt.Errorf("error fetching thermostats: %w", &ecobee.AuthError{Code: 14, Message: "Authentication token has expired."})
+		},
+		retry.Attempts(5),
+		retry.Delay(time.Millisecond),
+		retry.RetryIf(isRetryable),
+	)
+	if attempts != 1 {
+		t.Errorf("made %d attempts, want 1", attempts)
+	}
+	if !isAuthError(err) {
+		t.Errorf("error = %v, want an auth error", err)
+	}
+	if !strings.Contains(err.Error(), "re-authorize required") {
+		t.Errorf("error = %q, want it to say to re-authorize", err)
+	}
+}
+
+func TestHeatIndex(t *testing.T) {
+	// Values from the NWS heat index chart and calculator.
+	tests := []struct {
+		tempF, humidityPct, want float64
+	}{
+		{80, 40, 80},
+		{90, 70, 106},
+		{100, 40, 109},
+		{86, 90, 105},
+		// The low humidity adjustment.
+		{100, 10, 95},
+		// The high humidity adjustment.
+		{85, 90, 102},
+	}
+	for _, tt := range tests {
+		if got := HeatIndex(tt.tempF, tt.humidityPct); math.Abs(got-tt.want) > 1 {
+			t.Errorf("HeatIndex(%v, %v) = %.1f, want %v", tt.tempF, tt.humidityPct, got, tt.want)
+		}
+	}
+}
+
+func TestWindChill(t *testing.T) {
+	// Values from the NWS wind chill chart.
+	tests := []struct {
+		tempF, windMph, want float64
+	}{
+		{30, 10, 21},
+		{0, 15, -19},
+		{40, 5, 36},
+		// Outside the formula's range, the temperature is returned as is.
+		{51, 10, 51},
+		{30, 2, 30},
+	}
+	for _, tt := range tests {
+		if got := WindChill(tt.tempF, tt.windMph); math.Abs(got-tt.want) > 0.5 {
+			t.Errorf("WindChill(%v, %v) = %.1f, want %v", tt.tempF, tt.windMph, got, tt.want)
+		}
+	}
+}
+
+func TestApparentTemperature(t *testing.T) {
+	tests := []struct {
+		name                        string
+		tempF, humidityPct, windMph float64
+		want                        float64
+	}{
+		{"cold uses wind chill", 30, 50, 10, WindChill(30, 10)},
+		{"just below 50 uses wind chill", 49.9, 50, 10, WindChill(49.9, 10)},
+		{"50 is the temperature", 50, 50, 10, 50},
+		{"mild is the temperature", 65, 90, 20, 65},
+		{"80 is the temperature", 80, 90, 10, 80},
+		{"just above 80 uses heat index", 80.1, 90, 10, HeatIndex(80.1, 90)},
+		{"hot uses heat index", 90, 70, 10, HeatIndex(90, 70)},
+	}
+	for _, tt := range tests {
+		if got := ApparentTemperature(tt.tempF, tt.humidityPct, tt.windMph); got != tt.want {
+			t.Errorf("%s: ApparentTemperature(%v, %v, %v) = %v, want %v", tt.name, tt.tempF, tt.humidityPct, tt.windMph, got, tt.want)
+		}
+	}
+	if got := ApparentTemperature(30, 50, 10); got >= 30 {
+		t.Errorf("ApparentTemperature(30, 50, 10) = %v, want below 30", got)
+	}
+	if got := ApparentTemperature(90, 70, 10); got <= 90 {
+		t.Errorf("ApparentTemperature(90, 70, 10) = %v, want above 90", got)
+	}
+}
+
+func TestSetpointError(t *testing.T) {
+	tests := []struct {
+		mode   string
+		want   float64
+		wantOK bool
+	}{
+		{"heat", 1.5, true},
+		{"auxHeatOnly", 1.5, true},
+		{"cool", -5.5, true},
+		{"auto", 0, false},
+		{"off", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := SetpointError(69.5, 68, 75, tt.mode)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("SetpointError in %q = %v, %v, want %v, %v", tt.mode, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestDoUpdateTempError(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"heat", "1.5"},
+		{"cool", "-5.5"},
+		{"auto", ""},
+		{"off", ""},
+	}
+	for _, tt := range tests {
+		fields := reportFields(t, Config{}, map[string]string{
+			"zoneAveTemp":  "69.5",
+			"zoneHeatTemp": "68",
+			"zoneCoolTemp": "75",
+			"hvacMode":     tt.mode,
+		})
+		if got := fields["temp_error_°F"]; got != tt.want {
+			t.Errorf("temp_error_°F in %s mode = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestDoUpdateHVACMode(t *testing.T) {
+	fields := reportFields(t, Config{}, map[string]string{"zoneAveTemp": "70", "hvacMode": "heat"})
+	if got, want := fields["HVAC_mode"], `"heat"`; got != want {
+		t.Errorf("HVAC_mode = %s, want %s in %v", got, want, fields)
+	}
+}
+
+func TestRuntimeReportFieldsColumns(t *testing.T) {
+	// Every column must be one ecobee knows, with its exact case, or its
+	// field is never written.
+	known := map[string]bool{}
+	for _, col := range ecobee.RuntimeReportColumns {
+		known[col] = true
+	}
+	for col := range runtimeReportFields {
+		if !known[col] {
+			t.Errorf("runtimeReportFields has unknown column %q", col)
+		}
+	}
+}
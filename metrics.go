@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics about the connector itself, served on metrics_listen.
+var (
+	lastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ecobee_connector_last_success_timestamp",
+		Help: "Unix time of the last runtime report range written to Influx.",
+	})
+	apiErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ecobee_connector_api_errors_total",
+		Help: "Failed ecobee API calls.",
+	})
+	influxWriteErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ecobee_connector_influx_write_errors_total",
+		Help: "Failed writes to Influx, of runtime reports or current state.",
+	})
+	pointsWrittenTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ecobee_connector_points_written_total",
+		Help: "Points written to Influx, from runtime reports and current state.",
+	})
+)
+
+// serveMetrics serves the Prometheus metrics at /metrics on addr in the
+// background.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Unable to serve metrics on %s: %s", addr, err)
+		}
+	}()
+}
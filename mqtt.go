@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// runtimePublisher sends each runtime report row somewhere besides Influx.
+type runtimePublisher interface {
+	publishRuntime(thermostatID string, t time.Time, fields map[string]interface{}) error
+}
+
+// noPublisher is used when no MQTT broker is configured.
+type noPublisher struct{}
+
+func (noPublisher) publishRuntime(thermostatID string, t time.Time, fields map[string]interface{}) error {
+	return nil
+}
+
+// mqttPublisher publishes runtime rows as JSON to
+// `<prefix>/<thermostat_id>/runtime`.
+type mqttPublisher struct {
+	client mqtt.Client
+	prefix string
+}
+
+const mqttTimeout = 10 * time.Second
+
+func newRuntimePublisher(config Config) (runtimePublisher, error) {
+	if config.MQTTBroker == "" {
+		return noPublisher{}, nil
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.MQTTBroker).
+		SetClientID("ecobee-influx-connector").
+		SetUsername(config.MQTTUsername).
+		SetPassword(config.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		return nil, fmt.Errorf("timed out connecting to MQTT broker %s", config.MQTTBroker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("unable to connect to MQTT broker %s: %v", config.MQTTBroker, err)
+	}
+
+	prefix := config.MQTTTopicPrefix
+	if prefix == "" {
+		prefix = "ecobee"
+	}
+	return &mqttPublisher{client: client, prefix: prefix}, nil
+}
+
+func (p *mqttPublisher) publishRuntime(thermostatID string, t time.Time, fields map[string]interface{}) error {
+	payload := map[string]interface{}{"time": t.Format(time.RFC3339)}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	topic := runtimeTopic(p.prefix, thermostatID)
+	token := p.client.Publish(topic, 1, false, b)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return token.Error()
+}
+
+// runtimeTopic is the topic runtime report rows for thermostatID are published
+// to. The ID is sanitized so it can't add topic levels or wildcards.
+func runtimeTopic(prefix, thermostatID string) string {
+	return fmt.Sprintf("%s/%s/runtime", prefix, sanitizeTagValue(thermostatID))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// onlineCounts tracks, for the current day, how many polls found each
+// thermostat connected. It is saved to disk after every poll so a restart
+// doesn't reset the day's ratio.
+type onlineCounts struct {
+	Date      string         `json:"date"`
+	Connected map[string]int `json:"connected"`
+	Total     map[string]int `json:"total"`
+}
+
+func loadOnlineCounts(file string) *onlineCounts {
+	o := &onlineCounts{}
+	if b, err := ioutil.ReadFile(file); err == nil {
+		// A corrupted file just means starting the day over.
+		_ = json.Unmarshal(b, o)
+	}
+	if o.Connected == nil || o.Total == nil {
+		o.Connected = map[string]int{}
+		o.Total = map[string]int{}
+	}
+	return o
+}
+
+func (o *onlineCounts) save(file string) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0o644)
+}
+
+// record adds one poll's connection status, starting over on a new day.
+func (o *onlineCounts) record(now time.Time, summary map[string]ecobee.ThermostatSummary) {
+	date := now.Format("2006-01-02")
+	if o.Date != date {
+		o.Date = date
+		o.Connected = map[string]int{}
+		o.Total = map[string]int{}
+	}
+	for id, ts := range summary {
+		o.Total[id]++
+		if ts.Connected {
+			o.Connected[id]++
+		}
+	}
+}
+
+// writeOnlineRatio writes each thermostat's fraction of connected polls so
+// far today to the `ecobee_daily_summary` measurement. The point is stamped
+// with the start of the day, so each poll overwrites the previous value.
+func writeOnlineRatio(influxClient influxWriter, database string, o *onlineCounts, metadata map[string]map[string]string) error {
+	day, err := time.ParseInLocation("2006-01-02", o.Date, time.Local)
+	if err != nil {
+		return err
+	}
+
+	bp, _ := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: database})
+	for id, total := range o.Total {
+		if total == 0 {
+			continue
+		}
+		tags := addStaticTags(map[string]string{
+			"device_id": fmt.Sprintf("ecobee-%s", id),
+			"receiver":  "ecobee-influx-connector",
+		})
+		for k, v := range metadata[id] {
+			tags[k] = v
+		}
+		fields := map[string]interface{}{
+			"online_ratio": float64(o.Connected[id]) / float64(total),
+			"online_polls": o.Connected[id],
+			"total_polls":  total,
+		}
+		pt, err := influxclient.NewPoint("ecobee_daily_summary", tags, fields, day)
+		if err != nil {
+			return err
+		}
+		bp.AddPoint(pt)
+	}
+	return influxClient.Write(bp)
+}
+
+// updateOnlineRatio polls the thermostat summary, records which thermostats
+// are connected, and writes the updated ratios.
+func updateOnlineRatio(ctx context.Context, client EcobeeClient, influxClient influxWriter, database, thermostatIDs, file string, metadata map[string]map[string]string) error {
+	summary, err := thermostatSummary(ctx, client, thermostatIDs)
+	if err != nil {
+		return err
+	}
+
+	o := loadOnlineCounts(file)
+	o.record(time.Now(), summary)
+	if err := o.save(file); err != nil {
+		return err
+	}
+	return writeOnlineRatio(influxClient, database, o, metadata)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// programPoint creates an `ecobee_program` point with the climate (comfort
+// setting) the thermostat is currently running and that climate's scheduled
+// setpoints.
+func programPoint(program ecobee.Program, meta map[string]string, now time.Time) (*influxclient.Point, bool) {
+	climate, ok := program.CurrentClimate()
+	if !ok {
+		return nil, false
+	}
+
+	tags := map[string]string{
+		"climate_ref": climate.ClimateRef,
+	}
+	for k, v := range meta {
+		tags[k] = v
+	}
+
+	// Climate temperatures are in tenths of a degree.
+	fields := map[string]interface{}{
+		"current_climate":  climate.Name,
+		"setpoint_heat_°F": float64(climate.HeatTemp) / 10,
+		"setpoint_cool_°F": float64(climate.CoolTemp) / 10,
+	}
+
+	pt, err := influxclient.NewPoint("ecobee_program", tags, fields, now)
+	if err != nil {
+		return nil, false
+	}
+	return pt, true
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// proxyFunc returns the proxy to use for each request: httpProxy for http://
+// URLs and httpsProxy for https:// URLs, or the standard HTTP_PROXY,
+// HTTPS_PROXY, and NO_PROXY environment variables if neither is set. Proxy
+// URLs may be http://, https://, or socks5://.
+func proxyFunc(httpProxy, httpsProxy string) (func(*http.Request) (*url.URL, error), error) {
+	if httpProxy == "" && httpsProxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxies := map[string]*url.URL{}
+	for scheme, value := range map[string]string{"http": httpProxy, "https": httpsProxy} {
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		proxies[scheme] = u
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		return proxies[req.URL.Scheme], nil
+	}, nil
+}
+
+// proxyTransport returns a copy of http.DefaultTransport that uses proxy.
+func proxyTransport(proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxy
+	return t
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+)
+
+// lastRuntimeReportTimes returns the time of the newest `ecobee_runtime_report`
+// point in Influx for each thermostat, by thermostat ID. Thermostats with no
+// points are left out, as is everything when Influx can't be queried (for
+// example in a dry run). With several targets, only the first is asked.
+func lastRuntimeReportTimes(influxClient influxWriter) (map[string]time.Time, error) {
+	switch w := influxClient.(type) {
+	case *write1x:
+		return lastRuntimeReportTimes1x(w)
+	case *write2x:
+		return lastRuntimeReportTimes2x(w)
+	case *multiWriter:
+		return lastRuntimeReportTimes(w.writers[0])
+	case *asciiFieldWriter:
+		return lastRuntimeReportTimes(w.influxWriter)
+	}
+	return map[string]time.Time{}, nil
+}
+
+func lastRuntimeReportTimes1x(w *write1x) (map[string]time.Time, error) {
+	from := `"ecobee_runtime_report"`
+	if w.retentionPolicy != "" {
+		from = fmt.Sprintf(`"%s".%s`, w.retentionPolicy, from)
+	}
+	q := influxclient.NewQuery(fmt.Sprintf(`SELECT * FROM %s GROUP BY "device_id" ORDER BY time DESC LIMIT 1`, from), w.database, "")
+	resp, err := w.client.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+
+	times := map[string]time.Time{}
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			if len(series.Values) == 0 || len(series.Values[0]) == 0 {
+				continue
+			}
+			s, ok := series.Values[0][0].(string)
+			if !ok {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time %q: %v", s, err)
+			}
+			times[strings.TrimPrefix(series.Tags["device_id"], "ecobee-")] = t
+		}
+	}
+	return times, nil
+}
+
+func lastRuntimeReportTimes2x(w *write2x) (map[string]time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	// Fields have different types, so each one's newest point is found
+	// separately and then only the times are compared.
+	flux := fmt.Sprintf(`from(bucket: "%s")
+  |> range(start: 0)
+  |> filter(fn: (r) => r._measurement == "ecobee_runtime_report")
+  |> group(columns: ["device_id", "_field"])
+  |> last()
+  |> keep(columns: ["_time", "device_id"])
+  |> group(columns: ["device_id"])
+  |> max(column: "_time")`, w.bucket)
+	result, err := w.client.QueryAPI(w.org).Query(ctx, flux)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	times := map[string]time.Time{}
+	for result.Next() {
+		device, _ := result.Record().ValueByKey("device_id").(string)
+		times[strings.TrimPrefix(device, "ecobee-")] = result.Record().Time()
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+	return times, nil
+}
+
+// resumeDayFromInflux returns the last day that every one of the
+// comma-separated thermostatIDs has been written to Influx through, or "" if
+// any of them has nothing in Influx yet. The day of the newest point may only
+// be partly written, so it is fetched again.
+func resumeDayFromInflux(influxClient influxWriter, thermostatIDs string) (string, error) {
+	times, err := lastRuntimeReportTimes(influxClient)
+	if err != nil {
+		return "", err
+	}
+
+	var oldest time.Time
+	for _, id := range strings.Split(thermostatIDs, ",") {
+		t, ok := times[strings.TrimSpace(id)]
+		if !ok {
+			return "", nil
+		}
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return oldest.UTC().Add(-24 * time.Hour).Format("2006-01-02"), nil
+}
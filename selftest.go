@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+)
+
+const selfTestMeasurement = "ecobee_connector_selftest"
+
+// runSelfTest verifies the whole Influx write path by writing a probe point,
+// reading it back, and then deleting it. This catches permission and database
+// misconfigurations at startup rather than after the first real fetch.
+func runSelfTest(influxClient influxWriter, database string) error {
+	probe := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	bp, _ := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: database})
+	tags := map[string]string{
+		"probe": probe,
+	}
+	fields := map[string]interface{}{
+		"ok": true,
+	}
+	pt, err := influxclient.NewPoint(selfTestMeasurement, tags, fields, time.Now())
+	if err != nil {
+		return fmt.Errorf("unable to create probe point: %s", err)
+	}
+	bp.AddPoint(pt)
+	if err := influxClient.Write(bp); err != nil {
+		return fmt.Errorf("unable to write probe point: %s", err)
+	}
+
+	return checkProbe(influxClient, probe, pt.Time())
+}
+
+// checkProbe reads back and deletes the probe point, from every target when
+// there are several.
+func checkProbe(influxClient influxWriter, probe string, written time.Time) error {
+	switch w := influxClient.(type) {
+	case *write1x:
+		return selfTest1x(w, probe)
+	case *write2x:
+		return selfTest2x(w, probe, written)
+	case *asciiFieldWriter:
+		return checkProbe(w.influxWriter, probe, written)
+	case *multiWriter:
+		for i, target := range w.writers {
+			if err := checkProbe(target, probe, written); err != nil {
+				return fmt.Errorf("%s: %s", w.servers[i], err)
+			}
+		}
+	}
+	return nil
+}
+
+func selfTest1x(w *write1x, probe string) error {
+	from := fmt.Sprintf(`"%s"`, selfTestMeasurement)
+	if w.retentionPolicy != "" {
+		from = fmt.Sprintf(`"%s".%s`, w.retentionPolicy, from)
+	}
+	q := influxclient.NewQuery(fmt.Sprintf(`SELECT * FROM %s WHERE "probe" = '%s'`, from, probe), w.database, "")
+	resp, err := w.client.Query(q)
+	if err != nil {
+		return fmt.Errorf("unable to query probe point: %s", err)
+	}
+	if resp.Error() != nil {
+		return fmt.Errorf("unable to query probe point: %s", resp.Error())
+	}
+	if len(resp.Results) == 0 || len(resp.Results[0].Series) == 0 || len(resp.Results[0].Series[0].Values) == 0 {
+		return fmt.Errorf("probe point was written but could not be read back")
+	}
+
+	q = influxclient.NewQuery(fmt.Sprintf(`DELETE FROM "%s" WHERE "probe" = '%s'`, selfTestMeasurement, probe), w.database, "")
+	resp, err = w.client.Query(q)
+	if err != nil {
+		return fmt.Errorf("unable to delete probe point: %s", err)
+	}
+	if resp.Error() != nil {
+		return fmt.Errorf("unable to delete probe point: %s", resp.Error())
+	}
+
+	return nil
+}
+
+func selfTest2x(w *write2x, probe string, written time.Time) error {
+	ctx := context.Background()
+
+	flux := fmt.Sprintf(`from(bucket: "%s")
+  |> range(start: -1h)
+  |> filter(fn: (r) => r._measurement == "%s" and r.probe == "%s")`, w.bucket, selfTestMeasurement, probe)
+	result, err := w.client.QueryAPI(w.org).Query(ctx, flux)
+	if err != nil {
+		return fmt.Errorf("unable to query probe point: %s", err)
+	}
+	found := result.Next()
+	if result.Err() != nil {
+		return fmt.Errorf("unable to query probe point: %s", result.Err())
+	}
+	result.Close()
+	if !found {
+		return fmt.Errorf("probe point was written but could not be read back")
+	}
+
+	predicate := fmt.Sprintf(`_measurement="%s" AND probe="%s"`, selfTestMeasurement, probe)
+	err = w.client.DeleteAPI().DeleteWithName(ctx, w.org, w.bucket, written.Add(-time.Minute), written.Add(time.Minute), predicate)
+	if err != nil {
+		return fmt.Errorf("unable to delete probe point: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// sensorPoints creates one `ecobee_sensor` point per remote sensor (including
+// the thermostat's own sensor) with its current temperature and occupancy.
+func sensorPoints(sensors []ecobee.RemoteSensor, meta map[string]string, now time.Time) []*influxclient.Point {
+	points := []*influxclient.Point{}
+	for _, sensor := range sensors {
+		tags := map[string]string{
+			"sensor_id":   sensor.ID,
+			"sensor_name": sensor.Name,
+			"sensor_type": sensor.Type,
+		}
+		for k, v := range meta {
+			tags[k] = v
+		}
+
+		fields := map[string]interface{}{}
+		for _, c := range sensor.Capability {
+			switch c.Type {
+			case "temperature":
+				// Tenths of a degree, or "unknown" if the sensor is offline.
+				if t, err := strconv.Atoi(c.Value); err == nil {
+					fields["temperature_°F"] = float64(t) / 10
+				}
+			case "occupancy":
+				if o, err := strconv.ParseBool(c.Value); err == nil {
+					fields["occupancy"] = o
+				}
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		pt, err := influxclient.NewPoint("ecobee_sensor", tags, fields, now)
+		if err != nil {
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points
+}
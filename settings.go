@@ -0,0 +1,42 @@
+package main
+
+import (
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// settingsPoint creates an `ecobee_settings` point with the settings config
+// asks for: the ventilator settings and the setpoint limits. Thermostats
+// without a ventilator get no ventilator fields.
+func settingsPoint(settings ecobee.Settings, config Config, meta map[string]string, now time.Time) (*influxclient.Point, bool) {
+	fields := map[string]interface{}{}
+	if config.WriteVentilation && settings.VentilatorType != "" && settings.VentilatorType != "none" {
+		fields["ventilator_type"] = settings.VentilatorType
+		fields["ventilator_mode"] = settings.Vent
+		fields["ventilator_min_on_time_min"] = settings.VentilatorMinOnTime
+		fields["ventilator_min_on_time_home_min"] = settings.VentilatorMinOnTimeHome
+		fields["ventilator_min_on_time_away_min"] = settings.VentilatorMinOnTimeAway
+		fields["ventilator_free_cooling"] = settings.VentilatorFreeCooling
+		fields["ventilator_dehumidify"] = settings.VentilatorDehumidify
+	}
+	if config.WriteSetpointLimits {
+		// Settings temperatures are in tenths of a degree.
+		fields["heat_range_high_°F"] = float64(settings.HeatRangeHigh) / 10
+		fields["heat_range_low_°F"] = float64(settings.HeatRangeLow) / 10
+		fields["cool_range_high_°F"] = float64(settings.CoolRangeHigh) / 10
+		fields["cool_range_low_°F"] = float64(settings.CoolRangeLow) / 10
+		fields["auto_heat_cool_delta_°F"] = float64(settings.HeatCoolMinDelta) / 10
+	}
+	if len(fields) == 0 {
+		return nil, false
+	}
+
+	pt, err := influxclient.NewPoint("ecobee_settings", meta, fields, now)
+	if err != nil {
+		return nil, false
+	}
+	return pt, true
+}
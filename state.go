@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// currentStatePoller writes the thermostats' current state, such as remote
+// sensor readings, every interval. The runtime report only has a new day of
+// data once a day, so the current state can't wait for it.
+type currentStatePoller struct {
+	config       Config
+	client       EcobeeClient
+	influxClient influxWriter
+	metric       bool
+	// If set, points that haven't changed since they were last written are
+	// skipped.
+	changes *changeTracker
+	// If set, successful polls are recorded for the health check.
+	health *healthTracker
+}
+
+func newCurrentStatePoller(config Config, client EcobeeClient, influxClient influxWriter, changes *changeTracker) *currentStatePoller {
+	return &currentStatePoller{
+		config:       config,
+		client:       client,
+		influxClient: influxClient,
+		metric:       config.Units == "metric",
+		changes:      changes,
+	}
+}
+
+// enabled reports whether any current state is configured to be written.
+func (p *currentStatePoller) enabled() bool {
+	return p.config.WriteSensors || p.config.WriteWeather || p.config.WriteProgram ||
+		p.config.WriteEvents || p.config.WriteAlerts || p.config.WriteVentilation ||
+		p.config.WriteSetpointLimits || p.config.WriteOnlineRatio
+}
+
+// thermostatTags returns the tags for points about thermostat t.
+func thermostatTags(t ecobee.Thermostat) map[string]string {
+	tags := addStaticTags(map[string]string{
+		"device_id": fmt.Sprintf("ecobee-%s", t.Identifier),
+		"receiver":  "ecobee-influx-connector",
+	})
+	tags[thermostatNameTag] = t.Name
+	tags["thermostat_model"] = t.ModelNumber
+	tags["thermostat_brand"] = t.Brand
+	return tags
+}
+
+// points returns the current state points for thermostat t.
+func (p *currentStatePoller) points(t ecobee.Thermostat, now time.Time) []*influxclient.Point {
+	meta := thermostatTags(t)
+	var points []*influxclient.Point
+	if pt, ok := settingsPoint(t.Settings, p.config, meta, now); ok {
+		points = append(points, pt)
+	}
+	if p.config.WriteSensors {
+		points = append(points, sensorPoints(t.RemoteSensors, meta, now)...)
+	}
+	if p.config.WriteWeather {
+		if pt, ok := weatherPoint(t.Weather, meta, now, p.config.AlwaysWriteWeather); ok {
+			points = append(points, pt)
+		}
+	}
+	if p.config.WriteProgram {
+		if pt, ok := programPoint(t.Program, meta, now); ok {
+			points = append(points, pt)
+		}
+	}
+	if p.config.WriteEvents {
+		points = append(points, eventPoints(t.Events, meta, now)...)
+	}
+	if p.config.WriteAlerts {
+		points = append(points, alertPoints(t.Alerts, t.RemoteSensors, meta, now)...)
+	}
+	if p.metric {
+		for i, pt := range points {
+			points[i] = metricPoint(pt)
+		}
+	}
+	return points
+}
+
+// poll fetches the thermostats and writes their current state. For
+// write_online_ratio, it also records which thermostats are connected.
+func (p *currentStatePoller) poll(ctx context.Context) error {
+	thermostats, err := p.client.GetThermostats(ctx, ecobee.Selection{
+		SelectionType:  "thermostats",
+		SelectionMatch: p.config.ThermostatID,
+
+		IncludeSensors:  p.config.WriteSensors || p.config.WriteAlerts,
+		IncludeWeather:  p.config.WriteWeather,
+		IncludeProgram:  p.config.WriteProgram,
+		IncludeEvents:   p.config.WriteEvents,
+		IncludeAlerts:   p.config.WriteAlerts,
+		IncludeSettings: p.config.WriteVentilation || p.config.WriteSetpointLimits,
+	})
+	if err != nil {
+		return err
+	}
+	if err := p.write(thermostats, time.Now()); err != nil {
+		return err
+	}
+
+	if p.config.WriteOnlineRatio {
+		metadata := map[string]map[string]string{}
+		for _, t := range thermostats {
+			metadata[t.Identifier] = map[string]string{
+				thermostatNameTag:  t.Name,
+				"thermostat_model": t.ModelNumber,
+				"thermostat_brand": t.Brand,
+			}
+		}
+		err := updateOnlineRatio(ctx, p.client, p.influxClient, p.config.InfluxDatabase, p.config.ThermostatID,
+			path.Join(p.config.WorkDir, "online_counts.json"), metadata)
+		if err != nil {
+			return fmt.Errorf("unable to update online ratio: %v", err)
+		}
+	}
+	return nil
+}
+
+// write writes the current state points for thermostats.
+func (p *currentStatePoller) write(thermostats []ecobee.Thermostat, now time.Time) error {
+	bp, _ := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: p.config.InfluxDatabase})
+	for _, t := range thermostats {
+		for _, pt := range p.points(t, now) {
+			if p.changes == nil || p.changes.changed(pt, now) {
+				bp.AddPoint(pt)
+			}
+		}
+	}
+	if len(bp.Points()) == 0 {
+		return nil
+	}
+	if err := p.influxClient.Write(bp); err != nil {
+		influxWriteErrorsTotal.Inc()
+		debugInfluxWriteErrors.Add(1)
+		return err
+	}
+	pointsWrittenTotal.Add(float64(len(bp.Points())))
+	debugPointsWritten.Add(int64(len(bp.Points())))
+	if p.changes != nil {
+		p.changes.record(bp.Points(), now)
+	}
+	return nil
+}
+
+// run polls every interval until ctx is done.
+func (p *currentStatePoller) run(ctx context.Context, interval time.Duration) {
+	for {
+		err := p.poll(ctx)
+		if err != nil && ctx.Err() == nil {
+			logs.error("current state update failed", "error", err)
+		}
+		if p.health != nil {
+			if err == nil {
+				p.health.success(interval)
+			} else if ctx.Err() == nil {
+				p.health.failure(err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
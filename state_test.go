@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// pollState runs one current state poll of thermostat with config and
+// returns the lines written.
+func pollState(t *testing.T, config Config, thermostat ecobee.Thermostat) []string {
+	t.Helper()
+	server := newInfluxServer(t)
+	thermostat.Identifier = "123"
+	thermostat.Name = "Main"
+	client := &fakeEcobeeClient{thermostats: []ecobee.Thermostat{thermostat}}
+	config.ThermostatID = "123"
+	u := newTestUpdater(t, config, client, server)
+	p := newCurrentStatePoller(u.config, client, u.influxClient, nil)
+	if err := p.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return server.written()
+}
+
+// checkWritten checks that lines has one line for each of want, starting with
+// it.
+func checkWritten(t *testing.T, lines []string, want ...string) {
+	t.Helper()
+	if len(lines) != len(want) {
+		t.Fatalf("wrote %q, want %d lines", lines, len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]) {
+			t.Errorf("wrote %q, want prefix %q", lines[i], want[i])
+		}
+	}
+}
+
+func TestCurrentStatePollerSensors(t *testing.T) {
+	lines := pollState(t, Config{WriteSensors: true}, ecobee.Thermostat{
+		RemoteSensors: []ecobee.RemoteSensor{{
+			ID:   "rs:100",
+			Name: "Bedroom",
+			Type: "ecobee3_remote_sensor",
+			Capability: []ecobee.RemoteSensorCapability{
+				{Type: "temperature", Value: "685"},
+				{Type: "occupancy", Value: "true"},
+			},
+		}},
+	})
+	checkWritten(t, lines,
+		`ecobee_sensor,device_id=ecobee-123,receiver=ecobee-influx-connector,sensor_id=rs:100,sensor_name=Bedroom,sensor_type=ecobee3_remote_sensor,thermostat_name=Main occupancy=true,temperature_°F=68.5 `)
+}
+
+func TestCurrentStatePollerWeather(t *testing.T) {
+	lines := pollState(t, Config{WriteWeather: true}, ecobee.Thermostat{
+		Weather: ecobee.Weather{
+			Timestamp:      "2023-01-02 13:00:00",
+			WeatherStation: "ENV:123",
+			Forecasts:      []ecobee.WeatherForecast{{Temperature: 300, RelativeHumidity: 60}},
+		},
+	})
+	checkWritten(t, lines,
+		`ecobee_weather,device_id=ecobee-123,receiver=ecobee-influx-connector,thermostat_name=Main,weather_station=ENV:123 outdoor_humidity_%=60i,outdoor_temperature_°F=30,wind_chill_°F=30,wind_speed_mph=0 1672664400000000000`)
+}
+
+func TestCurrentStatePollerProgram(t *testing.T) {
+	lines := pollState(t, Config{WriteProgram: true}, ecobee.Thermostat{
+		Program: ecobee.Program{
+			CurrentClimateRef: "home",
+			Climates:          []ecobee.Climate{{Name: "Home", ClimateRef: "home", HeatTemp: 680, CoolTemp: 750}},
+		},
+	})
+	checkWritten(t, lines,
+		`ecobee_program,climate_ref=home,device_id=ecobee-123,receiver=ecobee-influx-connector,thermostat_name=Main current_climate="Home",setpoint_cool_°F=75,setpoint_heat_°F=68 `)
+}
+
+func TestCurrentStatePollerEvents(t *testing.T) {
+	lines := pollState(t, Config{WriteEvents: true}, ecobee.Thermostat{
+		Events: []ecobee.Event{
+			{Type: "hold", Name: "auto", Running: true, HeatHoldTemp: 700, CoolHoldTemp: 760,
+				StartDate: "2023-01-02", StartTime: "08:00:00", EndDate: "2023-01-02", EndTime: "17:00:00"},
+			{Type: "vacation", Name: "Trip", Running: false},
+		},
+	})
+	checkWritten(t, lines,
+		`ecobee_event,device_id=ecobee-123,event_name=auto,event_type=hold,receiver=ecobee-influx-connector,thermostat_name=Main cool_hold_temp_°F=76,end_time="2023-01-02 17:00:00",heat_hold_temp_°F=70,is_quick_save=false,is_vacation=false,start_time="2023-01-02 08:00:00" `)
+}
+
+func TestCurrentStatePollerStackedEvents(t *testing.T) {
+	// A hold on top of a vacation: both run at once, and both are kept.
+	lines := pollState(t, Config{WriteEvents: true}, ecobee.Thermostat{
+		Events: []ecobee.Event{
+			{Type: "hold", Name: "auto", Running: true, HeatHoldTemp: 700, CoolHoldTemp: 760},
+			{Type: "vacation", Name: "Trip", Running: true, HeatHoldTemp: 600, CoolHoldTemp: 820},
+		},
+	})
+	checkWritten(t, lines,
+		`ecobee_event,device_id=ecobee-123,event_name=auto,event_type=hold,receiver=ecobee-influx-connector,thermostat_name=Main cool_hold_temp_°F=76,`,
+		`ecobee_event,device_id=ecobee-123,event_name=Trip,event_type=vacation,receiver=ecobee-influx-connector,thermostat_name=Main cool_hold_temp_°F=82,`)
+}
+
+func TestCurrentStatePollerAlerts(t *testing.T) {
+	lines := pollState(t, Config{WriteAlerts: true}, ecobee.Thermostat{
+		RemoteSensors: []ecobee.RemoteSensor{{ID: "rs:100", Name: "Bedroom"}},
+		Alerts: []ecobee.Alert{{
+			Date: "2023-01-02", Time: "08:00:00", Severity: "low", AlertNumber: 611,
+			Text: "Bedroom sensor battery is low.", AlertType: "alert", NotificationType: "lowBattery",
+		}},
+	})
+	checkWritten(t, lines,
+		`ecobee_alert,alert_number=611,device_id=ecobee-123,receiver=ecobee-influx-connector,sensor_name=Bedroom,thermostat_name=Main alert_time="2023-01-02 08:00:00",alert_type="alert",low_battery=true,notification_type="lowBattery",severity="low",text="Bedroom sensor battery is low." `)
+}
+
+func TestCurrentStatePollerVentilation(t *testing.T) {
+	lines := pollState(t, Config{WriteVentilation: true}, ecobee.Thermostat{
+		Settings: ecobee.Settings{
+			VentilatorType:      "hrv",
+			Vent:                "auto",
+			VentilatorMinOnTime: 20,
+		},
+	})
+	checkWritten(t, lines,
+		`ecobee_settings,device_id=ecobee-123,receiver=ecobee-influx-connector,thermostat_name=Main ventilator_dehumidify=false,ventilator_free_cooling=false,ventilator_min_on_time_away_min=0i,ventilator_min_on_time_home_min=0i,ventilator_min_on_time_min=20i,ventilator_mode="auto",ventilator_type="hrv" `)
+
+	lines = pollState(t, Config{WriteVentilation: true}, ecobee.Thermostat{
+		Settings: ecobee.Settings{VentilatorType: "none"},
+	})
+	checkWritten(t, lines)
+}
+
+func TestCurrentStatePollerSetpointLimits(t *testing.T) {
+	thermostat := ecobee.Thermostat{
+		Settings: ecobee.Settings{
+			HeatRangeHigh:    790,
+			HeatRangeLow:     450,
+			CoolRangeHigh:    920,
+			CoolRangeLow:     500,
+			HeatCoolMinDelta: 50,
+		},
+	}
+	lines := pollState(t, Config{WriteSetpointLimits: true}, thermostat)
+	checkWritten(t, lines,
+		`ecobee_settings,device_id=ecobee-123,receiver=ecobee-influx-connector,thermostat_name=Main auto_heat_cool_delta_°F=5,cool_range_high_°F=92,cool_range_low_°F=50,heat_range_high_°F=79,heat_range_low_°F=45 `)
+
+	// The delta is a difference, so it is scaled but not offset.
+	lines = pollState(t, Config{WriteSetpointLimits: true, Units: "metric"}, thermostat)
+	checkWritten(t, lines,
+		`ecobee_settings,device_id=ecobee-123,receiver=ecobee-influx-connector,thermostat_name=Main auto_heat_cool_delta_°C=2.7777777777777777,cool_range_high_°C=33.333333333333336,cool_range_low_°C=10,heat_range_high_°C=26.11111111111111,heat_range_low_°C=7.222222222222222 `)
+}
+
+func TestCurrentStatePollerOnlineRatio(t *testing.T) {
+	server := newInfluxServer(t)
+	client := &fakeEcobeeClient{
+		thermostats: []ecobee.Thermostat{{Identifier: "123", Name: "Main"}},
+		summary:     map[string]ecobee.ThermostatSummary{"123": {Identifier: "123", Connected: true}},
+	}
+	config := Config{ThermostatID: "123", WriteOnlineRatio: true, WorkDir: t.TempDir()}
+	u := newTestUpdater(t, config, client, server)
+	p := newCurrentStatePoller(u.config, client, u.influxClient, nil)
+
+	ctx := context.Background()
+	if err := p.poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client.summary["123"] = ecobee.ThermostatSummary{Identifier: "123", Connected: false}
+	if err := p.poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := server.written()
+	if len(lines) != 2 {
+		t.Fatalf("wrote %q, want 2 lines", lines)
+	}
+	want := `ecobee_daily_summary,device_id=ecobee-123,receiver=ecobee-influx-connector,thermostat_name=Main online_polls=1i,online_ratio=0.5,total_polls=2i `
+	if !strings.HasPrefix(lines[1], want) {
+		t.Errorf("wrote %q, want prefix %q", lines[1], want)
+	}
+}
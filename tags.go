@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+)
+
+// staticTags are the static_tags from the config, added to every point.
+var staticTags map[string]string
+
+// reservedTags are the tags the connector sets itself, which static_tags may
+// not replace.
+var reservedTags = []string{
+	"device_id",
+	"receiver",
+	thermostatNameTag,
+	"thermostat_model",
+	"thermostat_brand",
+	"climate",
+	"climate_ref",
+	"event",
+	"event_type",
+	"event_name",
+	"sensor_id",
+	"sensor_name",
+	"sensor_type",
+	"weather_station",
+	"alert_number",
+}
+
+// addStaticTags adds staticTags to tags and returns it.
+func addStaticTags(tags map[string]string) map[string]string {
+	for k, v := range staticTags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Thermostat names may contain characters like spaces, commas, and equals
+// signs. The Influx client escapes tag values itself, but every other output
+// must go through one of these helpers.
+
+// Line protocol has no escape for a line break, so one becomes an escaped
+// space.
+var tagValueEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`,`, `\,`,
+	`=`, `\=`,
+	` `, `\ `,
+	"\r\n", `\ `,
+	"\n", `\ `,
+	"\r", `\ `,
+)
+
+// escapeTagValue escapes a tag value the same way Influx line protocol does,
+// for outputs that print or send line protocol themselves.
+func escapeTagValue(v string) string {
+	return tagValueEscaper.Replace(v)
+}
+
+// sanitizeTagValue replaces anything other than letters, digits, '-', and '_'
+// with '_', for outputs that use tag values as path or topic components where
+// escaping isn't possible.
+func sanitizeTagValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, v)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+)
+
+var tagValueTests = []struct {
+	name      string
+	in        string
+	escaped   string
+	sanitized string
+}{
+	{"plain", "Main", "Main", "Main"},
+	{"comma", "Up,stairs", `Up\,stairs`, "Up_stairs"},
+	{"space", "Living Room", `Living\ Room`, "Living_Room"},
+	{"equals", "a=b", `a\=b`, "a_b"},
+	{"newline", "Main\nFloor", `Main\ Floor`, "Main_Floor"},
+	{"crlf", "Main\r\nFloor", `Main\ Floor`, "Main__Floor"},
+	{"non-ASCII", "Küche", "Küche", "K_che"},
+	{"topic", "a/+/#", "a/+/#", "a____"},
+}
+
+func TestEscapeTagValue(t *testing.T) {
+	for _, tt := range tagValueTests {
+		if got := escapeTagValue(tt.in); got != tt.escaped {
+			t.Errorf("%s: escapeTagValue(%q) = %q, want %q", tt.name, tt.in, got, tt.escaped)
+		}
+	}
+}
+
+func TestSanitizeTagValue(t *testing.T) {
+	for _, tt := range tagValueTests {
+		if got := sanitizeTagValue(tt.in); got != tt.sanitized {
+			t.Errorf("%s: sanitizeTagValue(%q) = %q, want %q", tt.name, tt.in, got, tt.sanitized)
+		}
+	}
+}
+
+func TestRuntimeTopic(t *testing.T) {
+	if got, want := runtimeTopic("ecobee", "12/#"), "ecobee/12__/runtime"; got != want {
+		t.Errorf("runtimeTopic = %q, want %q", got, want)
+	}
+}
+
+// testBatch returns a batch with one ecobee_runtime_report point for a
+// thermostat called name.
+func testBatch(t *testing.T, name string) influxclient.BatchPoints {
+	t.Helper()
+	bp, err := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: "ecobee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := influxclient.NewPoint(
+		"ecobee_runtime_report",
+		map[string]string{thermostatNameTag: name},
+		map[string]interface{}{"temperature": 70.5, "hvac_mode": "heat", "count": int64(2), "on": true},
+		time.Unix(1600000000, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp.AddPoint(pt)
+	return bp
+}
+
+func TestPrintWriter(t *testing.T) {
+	for _, tt := range tagValueTests {
+		var out bytes.Buffer
+		w := &printWriter{out: &out}
+		if err := w.Write(testBatch(t, tt.in)); err != nil {
+			t.Fatal(err)
+		}
+		want := "ecobee_runtime_report,thermostat_name=" + tt.escaped +
+			` count=2i,hvac_mode="heat",on=true,temperature=70.5 1600000000000000000` + "\n"
+		if got := out.String(); got != want {
+			t.Errorf("%s: printed %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestPrintWriterMatchesClient(t *testing.T) {
+	pt := testBatch(t, "Main").Points()[0]
+	got, err := lineProtocol(pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := pt.String(); got != want {
+		t.Errorf("lineProtocol = %q, want %q", got, want)
+	}
+}
+
+func TestCSVWriterRawTags(t *testing.T) {
+	w := &csvWriter{}
+	if err := w.Write(testBatch(t, "Main\nFloor, Up")); err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(t.TempDir(), "out.csv")
+	if err := w.save(file); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "time,thermostat_name,count,hvac_mode,on,temperature\n" +
+		"2020-09-13T12:26:40Z,\"Main\nFloor, Up\",2,heat,true,70.5\n"
+	if got := string(b); got != want {
+		t.Errorf("saved %q, want %q", got, want)
+	}
+}
+
+func TestStaticTagsReserved(t *testing.T) {
+	for _, tag := range []string{"device_id", "climate", "event", "event_type", "weather_station", "alert_number"} {
+		config := Config{APIKey: "key", ThermostatID: "123", InfluxServer: "http://localhost:8086", InfluxDatabase: "ecobee", StaticTags: map[string]string{tag: "x"}}
+		errs := config.Validate()
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "static_tags") {
+			t.Errorf("static tag %q: Validate() = %v, want a static_tags error", tag, errs)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+)
+
+// FahrenheitToCelsius converts a temperature from °F to °C.
+func FahrenheitToCelsius(tempF float64) float64 {
+	return (tempF - 32) * 5 / 9
+}
+
+// MphToKmh converts a speed from miles/hour to kilometers/hour.
+func MphToKmh(mph float64) float64 {
+	return mph * 1.609344
+}
+
+// KmhToMph converts a speed from kilometers/hour to miles/hour.
+func KmhToMph(kmh float64) float64 {
+	return kmh / 1.609344
+}
+
+// metricFields returns a copy of fields with every `_°F` field converted to
+// `_°C` and every `_mph` field converted to `_kmh`. Fields with `delta` or
+// `error` in their name are temperature differences, so they are scaled but
+// not offset.
+func metricFields(fields map[string]interface{}) map[string]interface{} {
+	metric := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		f, isFloat := v.(float64)
+		switch {
+		case isFloat && strings.HasSuffix(k, "_°F"):
+			k = strings.TrimSuffix(k, "_°F") + "_°C"
+			if strings.Contains(k, "delta") || strings.Contains(k, "error") {
+				v = f * 5 / 9
+			} else {
+				v = FahrenheitToCelsius(f)
+			}
+		case isFloat && strings.HasSuffix(k, "_mph"):
+			k = strings.TrimSuffix(k, "_mph") + "_kmh"
+			v = MphToKmh(f)
+		}
+		metric[k] = v
+	}
+	return metric
+}
+
+// metricPoint returns pt with its fields converted by metricFields.
+func metricPoint(pt *influxclient.Point) *influxclient.Point {
+	fields, err := pt.Fields()
+	if err != nil {
+		return pt
+	}
+	converted, err := influxclient.NewPoint(pt.Name(), pt.Tags(), metricFields(fields), pt.Time())
+	if err != nil {
+		return pt
+	}
+	return converted
+}
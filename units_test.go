@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+func TestFahrenheitToCelsius(t *testing.T) {
+	tests := []struct{ f, c float64 }{
+		{32, 0},
+		{212, 100},
+		{-40, -40},
+		{98.6, 37},
+	}
+	for _, tt := range tests {
+		if got := FahrenheitToCelsius(tt.f); math.Abs(got-tt.c) > 1e-9 {
+			t.Errorf("FahrenheitToCelsius(%v) = %v, want %v", tt.f, got, tt.c)
+		}
+	}
+}
+
+func TestMphToKmh(t *testing.T) {
+	if got := MphToKmh(10); math.Abs(got-16.09344) > 1e-9 {
+		t.Errorf("MphToKmh(10) = %v, want 16.09344", got)
+	}
+	if got := KmhToMph(MphToKmh(25)); math.Abs(got-25) > 1e-9 {
+		t.Errorf("KmhToMph(MphToKmh(25)) = %v, want 25", got)
+	}
+}
+
+func TestMetricFields(t *testing.T) {
+	got := metricFields(map[string]interface{}{
+		"temperature_°F":   212.0,
+		"setpoint_heat_°F": 32.0,
+		"temp_error_°F":    9.0,
+		"wind_speed_mph":   10.0,
+		"humidity_%":       40.0,
+		"fan_run_time_s":   300,
+		"outdoor_delta_°F": -18.0,
+		"hvac_mode":        "heat",
+	})
+	want := map[string]interface{}{
+		"temperature_°C":   100.0,
+		"setpoint_heat_°C": 0.0,
+		"temp_error_°C":    5.0,
+		"wind_speed_kmh":   16.09344,
+		"humidity_%":       40.0,
+		"fan_run_time_s":   300,
+		"outdoor_delta_°C": -10.0,
+		"hvac_mode":        "heat",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("metricFields = %v, want %v", got, want)
+	}
+	for k, w := range want {
+		g, ok := got[k]
+		if !ok {
+			t.Errorf("no %s in %v", k, got)
+			continue
+		}
+		if wf, isFloat := w.(float64); isFloat {
+			if gf, _ := g.(float64); math.Abs(gf-wf) > 1e-9 {
+				t.Errorf("%s = %v, want %v", k, g, w)
+			}
+		} else if g != w {
+			t.Errorf("%s = %v, want %v", k, g, w)
+		}
+	}
+}
+
+func TestUnitsAutoRejected(t *testing.T) {
+	config := Config{APIKey: "key", ThermostatID: "123", InfluxServer: "http://localhost:8086", InfluxDatabase: "ecobee", Units: "auto"}
+	errs := config.Validate()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `invalid units "auto"`) {
+		t.Errorf("Validate() = %v, want an invalid units error", errs)
+	}
+}
+
+func TestMixedScaleThermostats(t *testing.T) {
+	// ecobee reports both thermostats in tenths of °F, whichever scale they
+	// display, so the same reading is written the same way for each.
+	server := newInfluxServer(t)
+	row := func() []ecobee.RuntimeReportDataEntry {
+		return []ecobee.RuntimeReportDataEntry{{
+			ReportTime: time.Date(2023, 1, 2, 13, 0, 0, 0, time.UTC),
+			DataFields: map[string]string{"zoneAveTemp": "68"},
+		}}
+	}
+	client := &fakeEcobeeClient{
+		reports: map[string][]ecobee.RuntimeReportDataEntry{"123": row(), "456": row()},
+	}
+	u := newTestUpdater(t, Config{ThermostatID: "123,456", Units: "metric"}, client, server)
+	if err := u.doUpdate(context.Background(), "2023-01-02", "2023-01-02"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := server.written()
+	if len(lines) != 2 {
+		t.Fatalf("wrote %q, want a line for each thermostat", lines)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, " temperature_°C=20 ") {
+			t.Errorf("wrote %q, want temperature_°C=20", line)
+		}
+	}
+}
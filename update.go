@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/avast/retry-go"
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// updater fetches runtime reports from ecobee and writes them to Influx. It
+// keeps the state that carries over from one update to the next.
+type updater struct {
+	config       Config
+	client       EcobeeClient
+	influxClient influxWriter
+	publisher    runtimePublisher
+	retryOpts    []retry.Option
+
+	writeOpts               writeOptions
+	metadataRefreshInterval time.Duration
+	metric                  bool
+	asciiNames              bool
+	// Whether zoneCalendarEvent was asked for in extra_runtime_columns, rather
+	// than only added for write_event_tag.
+	keepCalendarEventField bool
+	// Points are only printed or saved to CSV, so nothing is exported.
+	dryRun bool
+
+	apiFailures   *apiFailureTracker
+	newestWritten *newestReportTracker
+	counters      *counterTracker
+	dailyTotals   *dailyRuntimeTotals
+
+	warnedClimateCardinality bool
+	// Thermostat name/model/brand tags, by thermostat ID. They rarely change,
+	// so they're only fetched every metadataRefreshInterval unless a poll
+	// needs the thermostats for something else anyway.
+	thermostatMetadata map[string]map[string]string
+	// Firmware versions, by thermostat ID, refreshed with the metadata. They
+	// are written as a field, not a tag, so they don't add series.
+	thermostatFirmware map[string]string
+	metadataFetched    time.Time
+}
+
+// newUpdater creates an updater with the defaults for config. Callers may
+// change the other fields before the first update.
+func newUpdater(config Config, client EcobeeClient, influxClient influxWriter) *updater {
+	return &updater{
+		config:                  config,
+		client:                  client,
+		influxClient:            influxClient,
+		publisher:               noPublisher{},
+		writeOpts:               config.writeOptions(),
+		metadataRefreshInterval: time.Hour,
+		metric:                  config.Units == "metric",
+		asciiNames:              config.FieldNameStyle == "ascii",
+		keepCalendarEventField:  true,
+		apiFailures:             &apiFailureTracker{},
+		newestWritten:           &newestReportTracker{},
+		counters:                newCounterTracker(config.CounterFields),
+		dailyTotals:             newDailyRuntimeTotals(),
+	}
+}
+
+// runtimeRow is a runtime report row to publish once it has been written.
+type runtimeRow struct {
+	thermostatID string
+	time         time.Time
+	fields       map[string]interface{}
+}
+
+// doUpdate fetches and writes the runtime reports from start_str to end_str,
+// retrying on failure. If it was interrupted by a shutdown, ctx.Err() is
+// set.
+func (u *updater) doUpdate(ctx context.Context, start_str string, end_str string) error {
+	date_range := start_str + ".." + end_str
+	started := time.Now()
+	debugStartDate.Set(start_str)
+	debugEndDate.Set(end_str)
+	// Totals for the poll summary, from the attempt that succeeded.
+	var thermostatsWritten, pointsWritten int64
+	// Rows written by the attempt that succeeded, published after it.
+	var published []runtimeRow
+	var publishedMu sync.Mutex
+	err := retry.Do(
+		func() error {
+			published = nil
+			if u.config.WriteConnectorStatus {
+				defer func() {
+					writeConnectorStatus(u.influxClient, u.config.InfluxDatabase, u.apiFailures, u.newestWritten.get())
+				}()
+			}
+
+			s := ecobee.Selection{
+				SelectionType:  "thermostats",
+				SelectionMatch: u.config.ThermostatID,
+
+				IncludeProgram:         u.config.WriteClimateTag,
+				IncludeRuntime:         false,
+				IncludeExtendedRuntime: false,
+				IncludeVersion:         u.config.WriteFirmwareVersion,
+			}
+			atomic.StoreInt64(&thermostatsWritten, 0)
+			atomic.StoreInt64(&pointsWritten, 0)
+			counters := u.counters.clone()
+			dailyTotals := u.dailyTotals.clone()
+
+			needThermostats := s.IncludeProgram
+			if u.thermostatMetadata == nil || time.Since(u.metadataFetched) >= u.metadataRefreshInterval {
+				needThermostats = true
+			}
+			var thermostats []ecobee.Thermostat
+			if needThermostats {
+				ts, err := u.client.GetThermostats(ctx, s)
+				u.apiFailures.record(err)
+				if err != nil {
+					return err
+				}
+				thermostats = ts
+			}
+
+			thermostat_metadata := u.thermostatMetadata
+			thermostat_firmware := u.thermostatFirmware
+			if needThermostats {
+				thermostat_metadata = map[string]map[string]string{}
+				thermostat_firmware = map[string]string{}
+			}
+			thermostat_programs := map[string]ecobee.Program{}
+			for _, t := range thermostats {
+				thermostat_programs[t.Identifier] = t.Program
+
+				if u.config.WriteClimateTag && !u.warnedClimateCardinality {
+					for _, c := range t.Program.Climates {
+						if c.Owner == "user" {
+							logs.warn("custom climate; every climate is a distinct value of the climate tag", "thermostat_name", t.Name, "climate", c.Name)
+						}
+					}
+				}
+
+				meta := map[string]string{
+					"thermostat_name":  t.Name,
+					"thermostat_model": t.ModelNumber,
+					"thermostat_brand": t.Brand,
+				}
+
+				thermostat_metadata[t.Identifier] = meta
+				thermostat_firmware[t.Identifier] = t.Version.ThermostatFirmwareVersion
+			}
+			u.warnedClimateCardinality = true
+			if needThermostats {
+				u.thermostatMetadata = thermostat_metadata
+				u.thermostatFirmware = thermostat_firmware
+				u.metadataFetched = time.Now()
+			}
+
+			// Large ranges go through the asynchronous report job API.
+			getRuntimeReport := u.client.GetRuntimeReport
+			if u.config.ReportJobThresholdDays > 0 {
+				start, _ := time.Parse("2006-01-02", start_str)
+				end, _ := time.Parse("2006-01-02", end_str)
+				days := int(end.Sub(start).Hours()/24) + 1
+				if days >= u.config.ReportJobThresholdDays {
+					getRuntimeReport = u.client.GetRuntimeReportJob
+				}
+			}
+
+			// Thermostats with different equipment need different
+			// columns, so they're fetched separately.
+			report_data := map[string]interface{}{}
+			for _, group := range u.config.runtimeReportGroups(u.config.ThermostatID) {
+				data, rr_err := getRuntimeReport(ctx, group.thermostatIDs,
+					start_str, end_str,
+					group.columns.Humidifier,
+					group.columns.AuxHeat1,
+					group.columns.AuxHeat2,
+					group.columns.HeatPump1,
+					group.columns.HeatPump2,
+					group.columns.Cool1,
+					group.columns.Cool2,
+					u.config.ExtraRuntimeColumns)
+				u.apiFailures.record(rr_err)
+				if rr_err != nil {
+					return fmt.Errorf("unable to get runtime report from %s to %s: %w", start_str, end_str, rr_err)
+				}
+				for id, entries := range data {
+					report_data[id] = entries
+				}
+			}
+
+			// fmt.Printf("\n\n%v\n\n", report_data);
+
+			if len(report_data) == 0 {
+				logs.info("no runtime data for any thermostat", "date_range", date_range)
+			}
+
+			// writeThermostat builds and writes the batch for one thermostat.
+			writeThermostat := func(thermostat_id string, entries interface{}) error {
+				meta := addStaticTags(map[string]string{
+					"device_id": fmt.Sprintf("ecobee-%s", thermostat_id),
+					"receiver":  "ecobee-influx-connector",
+				})
+
+				// Copy in the thermostat data from the getThermostats call.
+				for k, v := range thermostat_metadata[thermostat_id] {
+					meta[k] = v
+				}
+
+				bp, _ := influxclient.NewBatchPoints(influxclient.BatchPointsConfig{Database: u.config.InfluxDatabase})
+				var newest time.Time
+				rows := []runtimeRow{}
+
+				if entries_ok, ok := entries.([]ecobee.RuntimeReportDataEntry); ok {
+					for _, entry := range entries_ok {
+
+						fields := map[string]interface{}{}
+
+						for key, val := range entry.DataFields {
+							f, ok := runtimeReportFields[key]
+							switch {
+							case !ok:
+								// Columns without a mapping, usually from
+								// extra_runtime_columns, keep their ecobee name.
+								fields[key] = runtimeColumnValue(val)
+							case f.kind == intField:
+								setIntField(fields, f.name, key, val)
+							case f.kind == floatField:
+								setFloatField(fields, f.name, key, val)
+							default:
+								fields[f.name] = val
+							}
+						}
+
+						if s, ok := FanOnlyRunTime(fields); ok {
+							fields["fan_only_run_time_s"] = s
+						}
+
+						t, tOK := fields["temperature_°F"].(float64)
+						heat, heatOK := fields["setpoint_heat_°F"].(float64)
+						cool, coolOK := fields["setpoint_cool_°F"].(float64)
+						if tOK && heatOK && coolOK {
+							if e, ok := SetpointError(t, heat, cool, entry.DataFields["hvacMode"]); ok {
+								fields["temp_error_°F"] = e
+							}
+						}
+						if outdoor, ok := fields["outdoor_temperature_°F"].(float64); ok && tOK {
+							fields["indoor_outdoor_delta_°F"] = t - outdoor
+						}
+
+						// Blank outdoor temperatures are left out of DataFields, so
+						// this is only written for rows with weather.
+						if outdoor, ok := fields["outdoor_temperature_°F"].(float64); ok {
+							fields["recommended_max_humidity_%"] = IndoorHumidityRecommendation(outdoor)
+						}
+
+						// The runtime report's wind speed is in km/h. Rows without
+						// weather leave it out.
+						if u.config.WriteWind {
+							if kmh, ok := fields["wind_km/h"].(int); ok {
+								mph := KmhToMph(float64(kmh))
+								fields["wind_speed_mph"] = mph
+								if outdoor, ok := fields["outdoor_temperature_°F"].(float64); ok {
+									fields["wind_chill_°F"] = WindChill(outdoor, mph)
+								}
+							}
+						}
+
+						if u.config.WriteCumulativeRuntime {
+							dailyTotals.apply(thermostat_id, entry.ThermostatTime, fields)
+						}
+
+						counters.apply(thermostat_id, fields)
+
+						if u.config.WriteEquipmentBitmask {
+							es := ecobee.RuntimeEquipmentStatus(entry.DataFields)
+							fields["equipment_bitmask"] = es.Bitmask()
+						}
+
+						if u.config.WriteComfortScore {
+							t, tOK := fields["temperature_°F"].(float64)
+							heat, heatOK := fields["setpoint_heat_°F"].(float64)
+							cool, coolOK := fields["setpoint_cool_°F"].(float64)
+							h, hOK := fields["humidity_%"].(float64)
+							outdoor, outdoorOK := fields["outdoor_temperature_°F"].(float64)
+							if tOK && heatOK && coolOK && hOK && outdoorOK {
+								fields["comfort_score"] = ComfortScore(t, heat, cool, h,
+									IndoorHumidityRecommendation(outdoor),
+									u.config.ComfortTempWeight, u.config.ComfortHumidityWeight)
+							}
+						}
+
+						if u.config.WriteDewpoint {
+							// Humidity of zero means the value is missing.
+							if t, ok := fields["outdoor_temperature_°F"].(float64); ok {
+								if h, ok := fields["outdoor_humidity_%"].(float64); ok && h > 0 {
+									fields["outdoor_dewpoint_°F"] = DewPoint(t, h)
+								}
+							}
+							if t, ok := fields["temperature_°F"].(float64); ok {
+								if h, ok := fields["humidity_%"].(float64); ok && h > 0 {
+									fields["indoor_dewpoint_°F"] = DewPoint(t, h)
+								}
+							}
+						}
+
+						if u.config.WriteApparentTemperature {
+							// Heat index needs the humidity, so rows without it are
+							// skipped. Rows without wind get no wind chill.
+							if t, ok := fields["outdoor_temperature_°F"].(float64); ok {
+								if h, ok := fields["outdoor_humidity_%"].(float64); ok && h > 0 {
+									var mph float64
+									if kmh, ok := fields["wind_km/h"].(int); ok {
+										mph = KmhToMph(float64(kmh))
+									}
+									fields["apparent_temperature_°F"] = ApparentTemperature(t, h, mph)
+								}
+							}
+						}
+
+						if u.config.WriteFirmwareVersion && len(fields) > 0 {
+							if v := thermostat_firmware[thermostat_id]; v != "" {
+								fields["firmware_version"] = v
+							}
+						}
+
+						if u.metric {
+							fields = metricFields(fields)
+						}
+						if u.config.WriteEventTag && !u.keepCalendarEventField {
+							delete(fields, "zoneCalendarEvent")
+						}
+						filterFields(fields, u.config.WriteFieldsInclude, u.config.WriteFieldsExclude)
+						if len(fields) == 0 {
+							continue
+						}
+
+						tags := meta
+						extraTags := map[string]string{}
+						if u.config.WriteClimateTag {
+							program := thermostat_programs[thermostat_id]
+							if climate, ok := program.ClimateAt(entry.ThermostatTime); ok {
+								extraTags["climate"] = climate
+							}
+						}
+						if u.config.WriteEventTag {
+							extraTags["event"] = calendarEventTag(entry.DataFields["zoneCalendarEvent"])
+						}
+						if len(extraTags) > 0 {
+							for k, v := range meta {
+								extraTags[k] = v
+							}
+							tags = extraTags
+						}
+
+						pt, _ := influxclient.NewPoint("ecobee_runtime_report", tags, fields, entry.ReportTime)
+						bp.AddPoint(pt)
+						if entry.ReportTime.After(newest) {
+							newest = entry.ReportTime
+						}
+						// fmt.Printf("added point %v\n", entry.ReportTime);
+
+						rows = append(rows, runtimeRow{thermostat_id, entry.ReportTime, fields})
+					}
+				}
+
+				if len(bp.Points()) == 0 {
+					logs.info("no runtime data, nothing to write", "thermostat_id", thermostat_id, "date_range", date_range)
+					return nil
+				}
+
+				logs.info("writing", "thermostat_id", thermostat_id, "date_range", date_range)
+
+				err := writeChunked(u.influxClient, bp, u.writeOpts)
+				// The export is saved with the outcome of the write, so
+				// -reconcile only picks up batches that didn't make it.
+				if u.config.JSONExportDir != "" && !u.dryRun {
+					written := err == nil
+					if _, exportErr := exportPoints(u.config.JSONExportDir, thermostat_id, start_str, end_str, bp.Points(), written); exportErr != nil {
+						logs.error("json export failed", "thermostat_id", thermostat_id, "date_range", date_range, "error", exportErr)
+					}
+				}
+				if err != nil {
+					influxWriteErrorsTotal.Inc()
+					debugInfluxWriteErrors.Add(1)
+					logs.error("write failed", "thermostat_id", thermostat_id, "date_range", date_range, "error", err)
+					return err
+				}
+				pointsWrittenTotal.Add(float64(len(bp.Points())))
+				debugPointsWritten.Add(int64(len(bp.Points())))
+				atomic.AddInt64(&thermostatsWritten, 1)
+				atomic.AddInt64(&pointsWritten, int64(len(bp.Points())))
+				u.newestWritten.update(newest)
+				logs.info("runtime write good", "thermostat_id", thermostat_id, "date_range", date_range, "points", len(bp.Points()))
+				publishedMu.Lock()
+				published = append(published, rows...)
+				publishedMu.Unlock()
+				return nil
+			}
+
+			ids := make([]string, 0, len(report_data))
+			for thermostat_id := range report_data {
+				ids = append(ids, thermostat_id)
+			}
+			sort.Strings(ids)
+			err := forEachConcurrently(ids, u.config.WriteConcurrency, func(thermostat_id string) error {
+				// Don't start on another thermostat once shutting down.
+				if ctx.Err() != nil {
+					return nil
+				}
+				return writeThermostat(thermostat_id, report_data[thermostat_id])
+			})
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return retry.Unrecoverable(ctx.Err())
+			}
+
+			// Everything was written, so the next window carries on from
+			// this one.
+			u.counters = counters
+			u.dailyTotals = dailyTotals
+			return nil
+		},
+		append(u.retryOpts, retry.Context(ctx))...,
+	)
+	if err != nil {
+		return err
+	}
+	for _, row := range published {
+		fields := row.fields
+		if u.asciiNames {
+			fields = asciiFields(fields)
+		}
+		if err := u.publisher.publishRuntime(row.thermostatID, row.time, fields); err != nil {
+			logs.error("mqtt publish failed", "thermostat_id", row.thermostatID, "error", err)
+		}
+	}
+	lastSuccessTimestamp.SetToCurrentTime()
+	debugLastSuccess.Set(time.Now().Format(time.RFC3339))
+	logs.info("poll complete",
+		"thermostats", atomic.LoadInt64(&thermostatsWritten),
+		"points", atomic.LoadInt64(&pointsWritten),
+		"date_range", date_range,
+		"elapsed", time.Since(started).Round(time.Millisecond).String())
+	return nil
+}
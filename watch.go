@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// watch prints the current state of each thermostat, refreshing the lines in
+// place every `interval`, until the program is stopped. Nothing is written
+// to Influx.
+func watch(client EcobeeClient, thermostatIDs string, interval time.Duration) {
+	s := ecobee.Selection{
+		SelectionType:  "thermostats",
+		SelectionMatch: thermostatIDs,
+
+		IncludeRuntime:         true,
+		IncludeSettings:        true,
+		IncludeEquipmentStatus: true,
+	}
+
+	fmt.Printf("%-20s %8s %6s %8s %8s %-8s %s\n", "THERMOSTAT", "TEMP", "HUMID", "HEAT", "COOL", "MODE", "RUNNING")
+	printed := 0
+	for {
+		thermostats, err := client.GetThermostats(context.Background(), s)
+		if err != nil {
+			log.Printf("Unable to get thermostats: %s", err)
+			printed = 0
+		} else {
+			// Move back up over the previous update.
+			if printed > 0 {
+				fmt.Printf("\033[%dA", printed)
+			}
+			for _, t := range thermostats {
+				running := strings.Replace(t.EquipmentStatus, ",", " ", -1)
+				if running == "" {
+					running = "idle"
+				}
+				fmt.Printf("\033[2K%-20.20s %6.1f°F %5d%% %6.1f°F %6.1f°F %-8s %s\n",
+					t.Name,
+					float64(t.Runtime.ActualTemperature)/10,
+					t.Runtime.ActualHumidity,
+					float64(t.Runtime.DesiredHeat)/10,
+					float64(t.Runtime.DesiredCool)/10,
+					t.Settings.HvacMode,
+					running)
+			}
+			printed = len(thermostats)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+
+	influxclient "github.com/influxdata/influxdb1-client/v2"
+
+	"ecobee_influx_connector/ecobee"
+)
+
+// weatherPoint creates an `ecobee_weather` point from the current conditions
+// (the first forecast) reported by the thermostat. The point is timestamped
+// with the forecast time, or with `now` if `writeAsCurrent` is set.
+func weatherPoint(weather ecobee.Weather, meta map[string]string, now time.Time, writeAsCurrent bool) (*influxclient.Point, bool) {
+	if len(weather.Forecasts) == 0 {
+		return nil, false
+	}
+	current := weather.Forecasts[0]
+
+	ts := now
+	if !writeAsCurrent {
+		t, err := time.Parse("2006-01-02 15:04:05", weather.Timestamp)
+		if err != nil {
+			return nil, false
+		}
+		ts = t
+	}
+
+	// Temperature is in tenths of a degree and wind speed in thousandths of
+	// a mile per hour.
+	tempF := float64(current.Temperature) / 10
+	windSpeedMph := float64(current.WindSpeed) / 1000
+	fields := map[string]interface{}{
+		"outdoor_temperature_°F": tempF,
+		"wind_speed_mph":         windSpeedMph,
+		"wind_chill_°F":          WindChill(tempF, windSpeedMph),
+		"outdoor_humidity_%":     current.RelativeHumidity,
+	}
+
+	tags := map[string]string{
+		"weather_station": weather.WeatherStation,
+	}
+	for k, v := range meta {
+		tags[k] = v
+	}
+
+	pt, err := influxclient.NewPoint("ecobee_weather", tags, fields, ts)
+	if err != nil {
+		return nil, false
+	}
+	return pt, true
+}